@@ -0,0 +1,222 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// MaxAliasDepth limits how many aliases a lookup follows before giving up
+const MaxAliasDepth = 8
+
+var (
+	ErrInvalidAlias   = errors.New("invalid alias")
+	ErrAliasConflict  = errors.New("alias collides with a live record")
+	ErrAliasCycle     = errors.New("alias would create a cycle")
+	ErrAliasNotFound  = errors.New("alias not found")
+	ErrTargetNotFound = errors.New("alias target not found")
+)
+
+// NormalizeAlias converts k to its idna form and checks that it is a single DNS label
+//
+// A single * is allowed to make k a wildcard alias matching any non-empty substring
+func NormalizeAlias(k string) (string, error) {
+	k = strings.ToLower(ToIdna(strings.TrimSpace(k)))
+	if len(k) == 0 || len(k) > 63 {
+		return "", fmt.Errorf("%w: %q must be 1 to 63 characters", ErrInvalidAlias, k)
+	}
+	if k[0] == '-' || k[len(k)-1] == '-' {
+		return "", fmt.Errorf("%w: %q must not start or end with a hyphen", ErrInvalidAlias, k)
+	}
+	if strings.Count(k, "*") > 1 {
+		return "", fmt.Errorf("%w: %q contains more than one *", ErrInvalidAlias, k)
+	}
+	for _, c := range k {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '*') {
+			return "", fmt.Errorf("%w: %q contains %q", ErrInvalidAlias, k, c)
+		}
+	}
+	return k, nil
+}
+
+// SetAlias is a validating version of Alias
+//
+// The target v is one of
+//
+//	<key>         a live record, or another alias
+//	?<tags>       the most recent record matching the tags, e.g. ?env=staging
+//
+// For a wildcard alias such as *-preview, every * in v is replaced with the
+// substring matched by the *, so *-preview => ?branch=* routes feat-preview
+// to the record tagged branch=feat
+//
+// It reports whether the alias was newly created, and refuses aliases that
+// are not a DNS label, that shadow a live record, whose target is not live,
+// or that would form a cycle
+func (s *Store) SetAlias(k string, v string) (created bool, err error) {
+	k, err = NormalizeAlias(k)
+	if err != nil {
+		return false, err
+	}
+	v = strings.TrimSpace(v)
+	if sel, ok := strings.CutPrefix(v, "?"); ok {
+		if _, err := url.ParseQuery(sel); err != nil {
+			return false, fmt.Errorf("%w: invalid tag selector %q", ErrInvalidAlias, v)
+		}
+	}
+	s.update(func(store *Store) {
+		if _, live := store.RecordMap[k]; live {
+			err = fmt.Errorf("%w: %s", ErrAliasConflict, k)
+			return
+		}
+		if err = store.checkTargetLocked(k, v); err != nil {
+			return
+		}
+		_, exists := store.AliasMap[k]
+		created = !exists
+		store.AliasMap[k] = v
+		store.touchLocked(k)
+	})
+	if err != nil {
+		return false, err
+	}
+	s.Events.Publish(aliasEvent(EventAliasSet, k, v))
+	return created, nil
+}
+
+// checkTargetLocked validates a plain target of alias k, caller must hold s.Lock
+//
+// Selectors and targets containing * are resolved at lookup time only
+func (s *Store) checkTargetLocked(k, v string) error {
+	if strings.HasPrefix(v, "?") || strings.Contains(v, "*") {
+		return nil
+	}
+	for depth := 0; depth <= MaxAliasDepth; depth++ {
+		if v == k {
+			return fmt.Errorf("%w: %s", ErrAliasCycle, k)
+		}
+		if _, live := s.RecordMap[v]; live {
+			return nil
+		}
+		next, ok := s.AliasMap[v]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrTargetNotFound, v)
+		}
+		if strings.HasPrefix(next, "?") || strings.Contains(next, "*") {
+			return nil
+		}
+		v = next
+	}
+	return fmt.Errorf("%w: %s is more than %d aliases away", ErrTargetNotFound, v, MaxAliasDepth)
+}
+
+// RemoveAlias is a version of Unalias that reports missing aliases
+func (s *Store) RemoveAlias(k string) (err error) {
+	k = strings.ToLower(ToIdna(strings.TrimSpace(k)))
+	s.update(func(store *Store) {
+		if _, ok := store.AliasMap[k]; !ok {
+			err = fmt.Errorf("%w: %s", ErrAliasNotFound, k)
+			return
+		}
+		delete(store.AliasMap, k)
+		store.touchLocked(k)
+	})
+	if err != nil {
+		return err
+	}
+	s.Events.Publish(aliasEvent(EventAliasRemoved, k, ""))
+	return nil
+}
+
+// Lookup resolves k through any number of aliases
+func (rt *Routes) Lookup(k string) (*Record, bool) {
+	// direct hits skip the bookkeeping of following aliases
+	if rec, ok := rt.Record(k); ok {
+		return rec, true
+	}
+	seen := map[string]bool{}
+	for depth := 0; depth <= MaxAliasDepth; depth++ {
+		if depth > 0 {
+			if rec, ok := rt.Record(k); ok {
+				return rec, true
+			}
+		}
+		if seen[k] {
+			rt.logger.Warn("alias cycle", "key", k)
+			return nil, false
+		}
+		seen[k] = true
+		target, capture, ok := rt.matchAlias(k)
+		if !ok {
+			return nil, false
+		}
+		target = strings.ReplaceAll(target, "*", capture)
+		if sel, ok := strings.CutPrefix(target, "?"); ok {
+			return rt.selectRecord(sel)
+		}
+		k = target
+	}
+	return nil, false
+}
+
+// matchAlias finds the alias for k, exact aliases win over wildcards
+// and longer wildcard patterns win over shorter ones
+func (rt *Routes) matchAlias(k string) (target, capture string, ok bool) {
+	if target, ok = rt.alias(k); ok {
+		return target, "", true
+	}
+	for _, pattern := range rt.wildcards {
+		if capture, ok = matchWildcard(pattern, k); ok {
+			return rt.wildcardTargets[pattern], capture, true
+		}
+	}
+	return "", "", false
+}
+
+// matchWildcard matches k against a pattern with a single *,
+// returning the non-empty substring matched by the *
+func matchWildcard(pattern, k string) (string, bool) {
+	prefix, suffix, _ := strings.Cut(pattern, "*")
+	if len(k) <= len(prefix)+len(suffix) {
+		return "", false
+	}
+	if !strings.HasPrefix(k, prefix) || !strings.HasSuffix(k, suffix) {
+		return "", false
+	}
+	return k[len(prefix) : len(k)-len(suffix)], true
+}
+
+// maxSelected bounds the selector results cached per snapshot, wildcard
+// captures put hostnames into selectors
+const maxSelected = 1024
+
+// selectRecord returns the most recent record whose tags match the selector
+//
+// Matching scans every record, the result is cached in the snapshot until
+// the next publish, which Store.UpdateTags forces.
+func (rt *Routes) selectRecord(sel string) (*Record, bool) {
+	if v, ok := rt.selected.Load(sel); ok {
+		rec := v.(*Record)
+		return rec, rec != nil
+	}
+	kvs, err := url.ParseQuery(sel)
+	if err != nil {
+		return nil, false
+	}
+	var found *Record
+	rt.eachShard(func(shard *routesShard) {
+		for _, rec := range shard.records {
+			if !rec.Matches(kvs) {
+				continue
+			}
+			if found == nil || rec.Since.After(found.Since) {
+				found = rec
+			}
+		}
+	})
+	if rt.nselected.Add(1) <= maxSelected {
+		rt.selected.Store(sel, found)
+	}
+	return found, found != nil
+}
@@ -0,0 +1,172 @@
+package relay
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/webteleport/webteleport/edge"
+)
+
+// ErrUnauthorized is returned when no credential is presented or accepted
+var ErrUnauthorized = errors.New("unauthorized")
+
+// Authenticator decides whether an edge may register a tunnel
+type Authenticator interface {
+	// Authenticate returns the principal owning the edge, or an error to reject it
+	Authenticate(r *edge.Edge) (principal string, err error)
+}
+
+// AuthenticatorFunc adapts a function to Authenticator
+type AuthenticatorFunc func(r *edge.Edge) (string, error)
+
+func (f AuthenticatorFunc) Authenticate(r *edge.Edge) (string, error) {
+	return f(r)
+}
+
+// Authenticators tries each Authenticator in order, the first success wins
+type Authenticators []Authenticator
+
+func (as Authenticators) Authenticate(r *edge.Edge) (string, error) {
+	err := ErrUnauthorized
+	for _, a := range as {
+		principal, aerr := a.Authenticate(r)
+		if aerr == nil {
+			return principal, nil
+		}
+		if !errors.Is(aerr, ErrUnauthorized) {
+			err = aerr
+		}
+	}
+	return "", err
+}
+
+// edgeToken returns the bearer token from the Authorization header,
+// falling back to the token query parameter for transports without headers
+func edgeToken(r *edge.Edge) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if token, ok := strings.CutPrefix(auth, "Bearer "); ok {
+			return token
+		}
+	}
+	return r.Values.Get("token")
+}
+
+// TokenAuthenticator accepts static bearer tokens / api keys
+type TokenAuthenticator struct {
+	// token => principal
+	Tokens map[string]string
+}
+
+func (a *TokenAuthenticator) Authenticate(r *edge.Edge) (string, error) {
+	token := edgeToken(r)
+	if token == "" {
+		return "", ErrUnauthorized
+	}
+	for t, principal := range a.Tokens {
+		if hmac.Equal([]byte(t), []byte(token)) {
+			return principal, nil
+		}
+	}
+	return "", fmt.Errorf("%w: invalid token", ErrUnauthorized)
+}
+
+// LoadTokenFile reads an api keys file with one "<token> <principal>" pair per line
+//
+// Empty lines and lines starting with # are ignored
+func LoadTokenFile(path string) (*TokenAuthenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	a := &TokenAuthenticator{Tokens: map[string]string{}}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"<token> <principal>\"", path, n)
+		}
+		a.Tokens[fields[0]] = fields[1]
+	}
+	return a, scanner.Err()
+}
+
+// HMACAuthenticator accepts query parameters signed with a shared secret
+//
+//	?principal=<name>&expires=<unix seconds>&sig=<hex hmac-sha256 of "<principal>:<expires>">
+type HMACAuthenticator struct {
+	Secret []byte
+}
+
+func (a *HMACAuthenticator) Authenticate(r *edge.Edge) (string, error) {
+	principal := r.Values.Get("principal")
+	expires := r.Values.Get("expires")
+	sig := r.Values.Get("sig")
+	if principal == "" || expires == "" || sig == "" {
+		return "", ErrUnauthorized
+	}
+	ts, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid expires", ErrUnauthorized)
+	}
+	if time.Now().Unix() > ts {
+		return "", fmt.Errorf("%w: signature expired", ErrUnauthorized)
+	}
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid sig", ErrUnauthorized)
+	}
+	if !hmac.Equal(got, a.Sign(principal, ts)) {
+		return "", fmt.Errorf("%w: invalid sig", ErrUnauthorized)
+	}
+	return principal, nil
+}
+
+// Sign computes the signature expected for principal until expires
+func (a *HMACAuthenticator) Sign(principal string, expires int64) []byte {
+	mac := hmac.New(sha256.New, a.Secret)
+	fmt.Fprintf(mac, "%s:%d", principal, expires)
+	return mac.Sum(nil)
+}
+
+// Authenticate returns the principal owning the edge
+//
+// All edges are accepted anonymously when no Authenticator is configured
+func (s *Store) Authenticate(r *edge.Edge) (string, error) {
+	if s.Authenticator == nil {
+		return "", nil
+	}
+	return s.Authenticator.Authenticate(r)
+}
+
+// authenticatorFromEnv builds an Authenticator from AUTH_TOKENS_FILE and AUTH_HMAC_SECRET
+func authenticatorFromEnv() (Authenticator, error) {
+	var as Authenticators
+	if path := os.Getenv("AUTH_TOKENS_FILE"); path != "" {
+		a, err := LoadTokenFile(path)
+		if err != nil {
+			return nil, err
+		}
+		as = append(as, a)
+	}
+	if secret := os.Getenv("AUTH_HMAC_SECRET"); secret != "" {
+		as = append(as, &HMACAuthenticator{Secret: []byte(secret)})
+	}
+	if len(as) == 0 {
+		return nil, nil
+	}
+	return as, nil
+}
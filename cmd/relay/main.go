@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/webteleport/relay"
 )
@@ -34,12 +38,19 @@ var (
 	QUIC_GO_PORT  = getEnv("QUIC_GO_PORT", "8082")
 	NET_QUIC_PORT = getEnv("NET_QUIC_PORT", "8083")
 	RELAY         = getEnv("RELAY", "https://relay.example.com")
+	// how long to drain clients on SIGINT or SIGTERM, like 30s
+	SHUTDOWN_TIMEOUT = getEnv("SHUTDOWN_TIMEOUT", "30s")
 )
 
 func main() {
 	log.SetFlags(log.Llongfile)
 	os.Setenv("VERBOSE", "1")
 
+	shutdownTimeout, err := time.ParseDuration(SHUTDOWN_TIMEOUT)
+	if err != nil {
+		log.Fatalf("invalid SHUTDOWN_TIMEOUT %q: %s", SHUTDOWN_TIMEOUT, err)
+	}
+
 	log.Println("HOST:", HOST)
 
 	s := relay.DefaultWSServer(HOST)
@@ -73,6 +84,27 @@ func main() {
 		go s.Subscribe(websocketUpgrader)
 	}
 
-	log.Println("Starting server on http://127.0.0.1:" + PORT)
-	http.ListenAndServe(":"+PORT, s)
+	srv := &http.Server{Addr: ":" + PORT, Handler: s}
+	go func() {
+		log.Println("Starting server on http://127.0.0.1:" + PORT)
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	<-ctx.Done()
+	stop()
+
+	// let clients drain before the http server goes away, proxied
+	// requests keep flowing through it until then
+	log.Println("Shutting down, draining for up to", shutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		log.Println("drain:", err)
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println("http shutdown:", err)
+	}
 }
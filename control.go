@@ -0,0 +1,388 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/webteleport/webteleport/edge"
+	"github.com/webteleport/webteleport/tunnel"
+	"golang.org/x/exp/maps"
+)
+
+// ControlVersion is the newest control protocol spoken by the relay
+//
+// Version 0 is the legacy text protocol (HOST, ERR, CLOSE, PONG, ...),
+// version 1 exchanges newline-delimited json ControlMessages. Clients opt
+// in at connect time with ?control=v1, optionally listing what they
+// understand in ?capabilities=a,b, and are greeted with a hello message
+// listing ControlCapabilities after the host message.
+const ControlVersion = 1
+
+// ControlCapabilities are the commands the relay accepts over version 1
+var ControlCapabilities = []string{"stats", "hostnames", "drain", "tags", "heartbeat"}
+
+// ControlMessage is a single message on the control stream, in either direction
+type ControlMessage struct {
+	Type string `json:"type"`
+	// echoed in replies to correlate them with requests
+	ID           string                  `json:"id,omitempty"`
+	Version      int                     `json:"version,omitempty"`
+	Capabilities []string                `json:"capabilities,omitempty"`
+	Host         string                  `json:"host,omitempty"`
+	Error        string                  `json:"error,omitempty"`
+	Reason       string                  `json:"reason,omitempty"`
+	Nonce        string                  `json:"nonce,omitempty"`
+	Signature    string                  `json:"signature,omitempty"`
+	Tags         url.Values              `json:"tags,omitempty"`
+	Hostnames    []string                `json:"hostnames,omitempty"`
+	Stats        *TransportStatsSnapshot `json:"stats,omitempty"`
+	// heartbeat sequence number, see Heartbeat
+	Seq int64 `json:"seq,omitempty"`
+}
+
+// text renders m in the legacy text protocol, ok is false if it has no text form
+func (m ControlMessage) text() (line string, ok bool) {
+	switch m.Type {
+	case "host":
+		return "HOST " + m.Host, true
+	case "error":
+		return "ERR " + m.Error, true
+	case "close":
+		return strings.TrimSpace("CLOSE " + m.Reason), true
+	case "challenge":
+		return "CHALLENGE " + m.Nonce, true
+	case "ping":
+		if m.Seq != 0 {
+			return fmt.Sprintf("PING %d", m.Seq), true
+		}
+		return "", true
+	case "standby", "promoted", "drain", "drained":
+		return strings.ToUpper(m.Type), true
+	}
+	return "", false
+}
+
+// ParseControlMessage parses a json line, or translates a legacy text line
+func ParseControlMessage(line string) (m ControlMessage, err error) {
+	if strings.HasPrefix(line, "{") {
+		err = json.Unmarshal([]byte(line), &m)
+		return m, err
+	}
+	cmd, arg, _ := strings.Cut(line, " ")
+	switch cmd {
+	case "":
+		m.Type = "noop"
+	case "PONG":
+		m.Type = "pong"
+		if arg != "" {
+			m.Seq, err = strconv.ParseInt(arg, 10, 64)
+		}
+	case "CLOSE":
+		m.Type = "close"
+		m.Reason = arg
+	case "SIGNATURE":
+		m.Type = "signature"
+		m.Signature = arg
+	case "TAGS":
+		m.Type = "tags"
+		m.Tags, err = url.ParseQuery(arg)
+	default:
+		return m, fmt.Errorf("unknown command: %s", line)
+	}
+	return m, nil
+}
+
+// Control writes to a client's control stream in the protocol version it negotiated
+//
+// Send is safe for concurrent use, there must be one Control per stream
+type Control struct {
+	Stream       tunnel.Stream
+	Version      int
+	Capabilities []string
+	// serializes the deadline, the write and its reset
+	lock sync.Mutex
+}
+
+func NewControl(r *edge.Edge) *Control {
+	c := &Control{Stream: r.Stream}
+	if r.Values.Get("control") == fmt.Sprintf("v%d", ControlVersion) {
+		c.Version = ControlVersion
+	}
+	if caps := r.Values.Get("capabilities"); caps != "" {
+		c.Capabilities = strings.Split(caps, ",")
+	}
+	return c
+}
+
+// answersPings reports whether the client replies PONG <seq> to PING <seq>
+func (c *Control) answersPings() bool {
+	return c.Version >= 1 || c.Supports("heartbeat")
+}
+
+// Supports reports whether the client advertised capability
+func (c *Control) Supports(capability string) bool {
+	return slices.Contains(c.Capabilities, capability)
+}
+
+// Send writes m, messages without a text form are dropped for legacy clients
+func (c *Control) Send(m ControlMessage) error {
+	var line string
+	if c.Version >= 1 {
+		b, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		line = string(b)
+	} else {
+		var ok bool
+		if line, ok = m.text(); !ok {
+			return nil
+		}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_ = c.Stream.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	defer c.Stream.SetWriteDeadline(time.Time{})
+	_, err := io.WriteString(c.Stream, line+"\n")
+	return err
+}
+
+// hello greets version 1 clients with the capabilities of the relay
+func (c *Control) hello() error {
+	if c.Version < 1 {
+		return nil
+	}
+	return c.Send(ControlMessage{
+		Type:         "hello",
+		Version:      ControlVersion,
+		Capabilities: ControlCapabilities,
+	})
+}
+
+// serveControl reads commands from the control stream of rec until it ends
+func (s *Store) serveControl(rec *Record) {
+	reason := ReasonEOF
+	scanner := bufio.NewScanner(rec.Control.Stream)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		m, err := ParseControlMessage(line)
+		if err != nil {
+			s.Logger.Warn(fmt.Sprintf("stm0: %s", err))
+			continue
+		}
+		if m.Type == "close" {
+			reason = ReasonClosed
+			break
+		}
+		if reply, ok := s.handleControl(rec, m); ok {
+			reply.ID = m.ID
+			if err := rec.Control.Send(reply); err != nil {
+				break
+			}
+		}
+	}
+	s.removeSession(rec.Session, reason)
+}
+
+// handleControl executes m on behalf of rec, returning the reply if there is one
+func (s *Store) handleControl(rec *Record, m ControlMessage) (ControlMessage, bool) {
+	switch m.Type {
+	case "noop":
+		return ControlMessage{}, false
+	case "pong":
+		if rec.Heartbeat != nil {
+			rec.Heartbeat.pong(m.Seq, time.Now())
+		}
+		return ControlMessage{}, false
+	case "stats":
+		stats := rec.Stats()
+		if stats == nil {
+			return ControlMessage{Type: "error", Error: "no stats for this record"}, true
+		}
+		snap := stats.Snapshot()
+		return ControlMessage{Type: "stats", Stats: &snap}, true
+	case "hostnames":
+		granted, err := s.requestHostnames(rec, m.Hostnames)
+		reply := ControlMessage{Type: "hostnames", Hostnames: granted}
+		if err != nil {
+			reply.Error = err.Error()
+		}
+		return reply, true
+	case "tags":
+		current, err := s.UpdateTags(rec, m.Tags)
+		reply := ControlMessage{Type: "tags", Tags: current}
+		if err != nil {
+			reply.Error = err.Error()
+		}
+		return reply, true
+	case "drain":
+		go s.drainRecord(rec, "requested")
+		return ControlMessage{Type: "drain"}, true
+	default:
+		return ControlMessage{Type: "error", Error: fmt.Sprintf("unknown command: %s", m.Type)}, true
+	}
+}
+
+// fixedTags are read once at connect time, changing them needs a reconnect
+var fixedTags = []string{
+	"protocol", "pubkey", "control", "capabilities",
+	"auth", "allow", "pool", "rps", "concurrency", "bps",
+	"token", "sig",
+}
+
+// UpdateTags replaces the tags of rec named in update, an empty list deletes
+// the tag. It returns the resulting tags of rec.
+func (s *Store) UpdateTags(rec *Record, update url.Values) (url.Values, error) {
+	for k := range update {
+		if slices.Contains(fixedTags, k) {
+			return rec.currentTags().Values, fmt.Errorf("tag %q can not be changed while connected", k)
+		}
+	}
+	var current url.Values
+	s.update(func(store *Store) {
+		current = maps.Clone(rec.Tags.Values)
+		if current == nil {
+			current = url.Values{}
+		}
+		for k, v := range update {
+			if len(v) == 0 {
+				current.Del(k)
+			} else {
+				current[k] = slices.Clone(v)
+			}
+		}
+		// swap rather than modify, readers may still hold the old values
+		rec.mu.Lock()
+		rec.Tags.Values = current
+		rec.mu.Unlock()
+		// republish, selectors cached in the snapshot may now match differently
+		store.touchLocked(rec.Key)
+	})
+	s.Events.Publish(recordEvent(EventRecordUpdated, rec))
+	s.Logger.Debug("tags", "key", rec.Key, "tags", current)
+	return current, nil
+}
+
+// ErrHostnameTaken is returned when a requested hostname is aliased to another key
+var ErrHostnameTaken = errors.New("hostname is taken")
+
+// requestHostnames aliases names to rec, they are released when rec goes away
+//
+// Names aliased elsewhere are refused, so are names beyond s.MaxHostnames.
+// Names already aliased to rec.Key are granted but left to whoever set them.
+func (s *Store) requestHostnames(rec *Record, names []string) (granted []string, err error) {
+	for _, name := range names {
+		if strings.Contains(name, "*") {
+			return granted, fmt.Errorf("%w: wildcards are not allowed: %s", ErrInvalidAlias, name)
+		}
+		if name, err = NormalizeAlias(name); err != nil {
+			return granted, err
+		}
+		var created bool
+		s.update(func(store *Store) {
+			created, err = store.grantHostnameLocked(rec, name)
+		})
+		if err != nil {
+			return granted, err
+		}
+		if created {
+			s.Events.Publish(aliasEvent(EventAliasSet, name, rec.Key))
+		}
+		granted = append(granted, name)
+	}
+	return granted, nil
+}
+
+// grantHostnameLocked aliases name to rec, caller must hold s.Lock
+func (s *Store) grantHostnameLocked(rec *Record, name string) (created bool, err error) {
+	if s.Sessions[rec.Session][rec.Key] != rec {
+		return false, fmt.Errorf("%w: %s", ErrTargetNotFound, rec.Key)
+	}
+	if _, live := s.RecordMap[name]; live {
+		return false, fmt.Errorf("%w: %s", ErrAliasConflict, name)
+	}
+	if target, ok := s.AliasMap[name]; ok {
+		if target != rec.Key {
+			return false, fmt.Errorf("%w: %s", ErrHostnameTaken, name)
+		}
+		return false, nil
+	}
+	if s.MaxHostnames > 0 && len(rec.Hostnames) >= s.MaxHostnames {
+		return false, fmt.Errorf("%w: %d hostnames per record", ErrQuotaExceeded, s.MaxHostnames)
+	}
+	if err := s.checkTargetLocked(name, rec.Key); err != nil {
+		return false, err
+	}
+	s.AliasMap[name] = rec.Key
+	s.touchLocked(name)
+	s.grants[rec.Key] = append(s.grants[rec.Key], name)
+	rec.mu.Lock()
+	rec.Hostnames = append(rec.Hostnames, name)
+	rec.mu.Unlock()
+	return true, nil
+}
+
+// releaseHostnames removes the aliases granted to rec unless its key is still served
+func (s *Store) releaseHostnames(rec *Record) {
+	var released []string
+	s.update(func(store *Store) {
+		released = store.releaseHostnamesLocked(rec.Key)
+	})
+	for _, name := range released {
+		s.Events.Publish(aliasEvent(EventAliasRemoved, name, ""))
+	}
+}
+
+// releaseHostnamesLocked removes the aliases granted to the records of k
+// once k is no longer served, caller must hold s.Lock
+//
+// Aliases set by an operator over a granted hostname are left alone.
+func (s *Store) releaseHostnamesLocked(k string) (released []string) {
+	if _, live := s.RecordMap[k]; live {
+		return nil
+	}
+	for _, name := range s.grants[k] {
+		if s.AliasMap[name] == k {
+			delete(s.AliasMap, name)
+			s.touchLocked(name)
+			released = append(released, name)
+		}
+	}
+	delete(s.grants, k)
+	return released
+}
+
+// grantedLocked lists the aliases currently held by granted hostnames,
+// caller must hold s.Lock
+func (s *Store) grantedLocked() map[string]bool {
+	granted := map[string]bool{}
+	for k, names := range s.grants {
+		for _, name := range names {
+			if s.AliasMap[name] == k {
+				granted[name] = true
+			}
+		}
+	}
+	return granted
+}
+
+// drainRecord stops routing new traffic to rec, waits up to s.DrainTimeout
+// for its active requests to finish, then closes its session
+func (s *Store) drainRecord(rec *Record, reason string) {
+	s.unroute(rec.Session, ReasonDrained)
+	ctx, cancel := context.WithTimeout(context.Background(), s.DrainTimeout)
+	defer cancel()
+	_ = waitIdle(ctx, rec)
+	_ = rec.Control.Send(ControlMessage{Type: "drained", Reason: reason})
+	_ = rec.Session.Close()
+}
@@ -0,0 +1,152 @@
+package relay
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/btwiuse/tags"
+)
+
+type EventType string
+
+const (
+	EventRecordInserted EventType = "record.inserted"
+	EventRecordUpdated  EventType = "record.updated"
+	EventRecordRemoved  EventType = "record.removed"
+	EventAliasSet       EventType = "alias.set"
+	EventAliasRemoved   EventType = "alias.removed"
+)
+
+// Event describes a change to a Store
+type Event struct {
+	Type EventType `json:"type"`
+	Key  string    `json:"key"`
+	// alias target, only set for alias events
+	Target string    `json:"target,omitempty"`
+	IP     string    `json:"ip,omitempty"`
+	Tags   tags.Tags `json:"tags"`
+	// why a record was removed, only set for record.removed
+	Reason string    `json:"reason,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+func recordEvent(t EventType, rec *Record) Event {
+	return Event{
+		Type: t,
+		Key:  rec.Key,
+		IP:   rec.IP,
+		Tags: rec.currentTags(),
+		Time: time.Now(),
+	}
+}
+
+func removedEvent(rec *Record, reason string) Event {
+	e := recordEvent(EventRecordRemoved, rec)
+	e.Reason = reason
+	return e
+}
+
+func aliasEvent(t EventType, k, v string) Event {
+	return Event{
+		Type:   t,
+		Key:    k,
+		Target: v,
+		Time:   time.Now(),
+	}
+}
+
+// EventBus fans out events to subscribers without ever blocking the publisher
+//
+// A subscriber that falls behind by more than its buffer is dropped,
+// its channel is closed so that it can resubscribe and resync
+type EventBus struct {
+	lock sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subs: map[chan Event]struct{}{},
+	}
+}
+
+// Subscribe returns a channel of events published from now on, and a func to unsubscribe
+func (b *EventBus) Subscribe(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+	b.lock.Lock()
+	b.subs[ch] = struct{}{}
+	b.lock.Unlock()
+	cancel := func() {
+		b.lock.Lock()
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+		b.lock.Unlock()
+	}
+	return ch, cancel
+}
+
+func (b *EventBus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+	b.lock.Unlock()
+}
+
+// Watch subscribes to changes of the store
+func (s *Store) Watch() (<-chan Event, func()) {
+	return s.Events.Subscribe(64)
+}
+
+// EventsHandler streams store changes as server-sent events
+func (i *IngressHandler) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	events, cancel := i.storage.Watch()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case e, ok := <-events:
+			if !ok {
+				// dropped for being too slow, let the client reconnect
+				return
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+		}
+		flusher.Flush()
+	}
+}
@@ -9,6 +9,7 @@ type ExpVarStruct struct {
 	WebteleportRelayStreamsClosed    *expvar.Int
 	WebteleportRelaySessionsAccepted *expvar.Int
 	WebteleportRelaySessionsClosed   *expvar.Int
+	WebteleportRelayQuotaExceeded    *expvar.Int
 }
 
 func NewExpVarStruct() *ExpVarStruct {
@@ -17,6 +18,7 @@ func NewExpVarStruct() *ExpVarStruct {
 		WebteleportRelayStreamsClosed:    expvar.NewInt("webteleport_relay_streams_closed"),
 		WebteleportRelaySessionsAccepted: expvar.NewInt("webteleport_relay_sessions_accepted"),
 		WebteleportRelaySessionsClosed:   expvar.NewInt("webteleport_relay_sessions_closed"),
+		WebteleportRelayQuotaExceeded:    expvar.NewInt("webteleport_relay_quota_exceeded"),
 	}
 }
 
@@ -10,7 +10,6 @@ require (
 	github.com/btwiuse/muxr v0.0.1
 	github.com/btwiuse/proxy v0.0.0
 	github.com/btwiuse/tags v0.0.2
-	github.com/phayes/freeport v0.0.0-20220201140144-74d24b5ae9f5
 	github.com/quic-go/quic-go v0.59.1
 	github.com/quic-go/webtransport-go v0.10.0
 	github.com/webteleport/utils v0.2.19
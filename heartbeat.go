@@ -0,0 +1,128 @@
+package relay
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// heartbeatWindow is the number of round trips averaged into Heartbeat.RTT
+const heartbeatWindow = 16
+
+// Heartbeat tracks the pings sent to a client and its round trip time
+//
+// Only clients that answer pings get one: version 1 clients, and text
+// clients that advertise the heartbeat capability. The relay sends
+// PING <seq> and expects PONG <seq> back within Store.PingTimeout.
+type Heartbeat struct {
+	lock    sync.Mutex
+	seq     int64
+	pending map[int64]time.Time
+	rtts    []time.Duration
+	last    time.Duration
+	misses  int
+}
+
+// HeartbeatSnapshot is the json form of a Heartbeat
+type HeartbeatSnapshot struct {
+	// mean of the recent round trips
+	RTT     time.Duration `json:"rtt"`
+	LastRTT time.Duration `json:"lastRtt"`
+	// consecutive pings left unanswered
+	Misses int `json:"misses"`
+}
+
+func NewHeartbeat() *Heartbeat {
+	return &Heartbeat{pending: map[int64]time.Time{}}
+}
+
+// ping allocates the sequence number of a ping sent at now
+func (h *Heartbeat) ping(now time.Time) int64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.seq++
+	h.pending[h.seq] = now
+	return h.seq
+}
+
+// pong records the answer to ping seq, late or unknown answers are ignored
+func (h *Heartbeat) pong(seq int64, now time.Time) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	sent, ok := h.pending[seq]
+	if !ok {
+		return
+	}
+	delete(h.pending, seq)
+	h.last = now.Sub(sent)
+	h.rtts = append(h.rtts, h.last)
+	if len(h.rtts) > heartbeatWindow {
+		h.rtts = h.rtts[1:]
+	}
+	h.misses = 0
+}
+
+// expire counts the pings unanswered for longer than timeout as missed,
+// and returns the number of consecutive misses
+func (h *Heartbeat) expire(now time.Time, timeout time.Duration) int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for seq, sent := range h.pending {
+		if now.Sub(sent) > timeout {
+			delete(h.pending, seq)
+			h.misses++
+		}
+	}
+	return h.misses
+}
+
+func (h *Heartbeat) Snapshot() (snap HeartbeatSnapshot) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, rtt := range h.rtts {
+		snap.RTT += rtt
+	}
+	if len(h.rtts) > 0 {
+		snap.RTT /= time.Duration(len(h.rtts))
+	}
+	snap.LastRTT = h.last
+	snap.Misses = h.misses
+	return
+}
+
+func (h *Heartbeat) MarshalJSON() ([]byte, error) {
+	return json.Marshal(h.Snapshot())
+}
+
+// heartbeat pings the client of rec every s.PingInterval until its session
+// ends, and evicts rec after s.PingMisses consecutive unanswered pings
+//
+// Clients without a Heartbeat only get blank keepalive lines.
+func (s *Store) heartbeat(rec *Record) {
+	if s.PingInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rec.Session.Context().Done():
+			return
+		case now := <-ticker.C:
+			m := ControlMessage{Type: "ping"}
+			if hb := rec.Heartbeat; hb != nil {
+				if misses := hb.expire(now, s.PingTimeout); s.PingMisses > 0 && misses >= s.PingMisses {
+					s.Logger.Info("evict", "key", rec.Key, "ip", rec.IP, "reason", ReasonHeartbeat, "misses", misses)
+					s.evict(rec, ReasonHeartbeat)
+					return
+				}
+				m.Seq = hb.ping(now)
+			}
+			if err := rec.Control.Send(m); err != nil {
+				// serveControl notices the closed session and removes rec
+				_ = rec.Session.Close()
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package relay
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultDurationBuckets are the upper bounds of request duration histograms
+var DefaultDurationBuckets = []time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// DefaultLatencyWindows are the sliding windows reported in LatencySummaries
+var DefaultLatencyWindows = map[string]time.Duration{
+	"1m": time.Minute,
+	"5m": 5 * time.Minute,
+	"1h": time.Hour,
+}
+
+// resolution and retention of Histogram.Window
+const (
+	windowSlot  = time.Minute
+	windowSlots = 61
+)
+
+// Histogram counts durations into fixed buckets, it is safe for concurrent use
+//
+// Besides lifetime totals it keeps per-minute counts of the last hour,
+// so that recent latency can be queried with Window
+type Histogram struct {
+	Bounds []time.Duration
+	// counts[i] observations <= Bounds[i], the last one is +Inf
+	counts []atomic.Int64
+	sum    atomic.Int64
+	count  atomic.Int64
+
+	lock  sync.Mutex
+	slots [windowSlots]histogramSlot
+}
+
+type histogramSlot struct {
+	minute int64
+	counts []int64
+	sum    int64
+	count  int64
+}
+
+// HistogramSnapshot is a point-in-time copy of a Histogram
+type HistogramSnapshot struct {
+	Bounds []time.Duration `json:"bounds"`
+	// non-cumulative, one more than Bounds for the +Inf bucket
+	Counts []int64       `json:"counts"`
+	Sum    time.Duration `json:"sum"`
+	Count  int64         `json:"count"`
+}
+
+// LatencySummary condenses a HistogramSnapshot into mean and percentiles
+type LatencySummary struct {
+	Count int64         `json:"count"`
+	Mean  time.Duration `json:"mean"`
+	P50   time.Duration `json:"p50"`
+	P95   time.Duration `json:"p95"`
+	P99   time.Duration `json:"p99"`
+}
+
+func NewHistogram(bounds []time.Duration) *Histogram {
+	return &Histogram{
+		Bounds: bounds,
+		counts: make([]atomic.Int64, len(bounds)+1),
+	}
+}
+
+func (h *Histogram) bucket(d time.Duration) int {
+	return sort.Search(len(h.Bounds), func(i int) bool { return d <= h.Bounds[i] })
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	i := h.bucket(d)
+	h.counts[i].Add(1)
+	h.sum.Add(int64(d))
+	h.count.Add(1)
+
+	minute := time.Now().UnixNano() / int64(windowSlot)
+	h.lock.Lock()
+	slot := &h.slots[minute%windowSlots]
+	if slot.minute != minute || slot.counts == nil {
+		slot.minute = minute
+		slot.counts = make([]int64, len(h.Bounds)+1)
+		slot.sum = 0
+		slot.count = 0
+	}
+	slot.counts[i]++
+	slot.sum += int64(d)
+	slot.count++
+	h.lock.Unlock()
+}
+
+// Snapshot returns the lifetime distribution
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	snap := HistogramSnapshot{
+		Bounds: h.Bounds,
+		Counts: make([]int64, len(h.counts)),
+		Sum:    time.Duration(h.sum.Load()),
+		Count:  h.count.Load(),
+	}
+	for i := range h.counts {
+		snap.Counts[i] = h.counts[i].Load()
+	}
+	return snap
+}
+
+// Window returns the distribution of observations made during at least the last w,
+// counted in whole minutes including the current one, and capped at one hour
+func (h *Histogram) Window(w time.Duration) HistogramSnapshot {
+	snap := HistogramSnapshot{
+		Bounds: h.Bounds,
+		Counts: make([]int64, len(h.Bounds)+1),
+	}
+	now := time.Now().UnixNano() / int64(windowSlot)
+	oldest := now - int64((w+windowSlot-1)/windowSlot) - 1
+	h.lock.Lock()
+	for _, slot := range h.slots {
+		if slot.counts == nil || slot.minute <= oldest || slot.minute > now {
+			continue
+		}
+		for i, c := range slot.counts {
+			snap.Counts[i] += c
+		}
+		snap.Sum += time.Duration(slot.sum)
+		snap.Count += slot.count
+	}
+	h.lock.Unlock()
+	return snap
+}
+
+// Summaries reports the lifetime summary as "all" along with one per DefaultLatencyWindows
+func (h *Histogram) Summaries() map[string]LatencySummary {
+	all := map[string]LatencySummary{
+		"all": h.Snapshot().Summary(),
+	}
+	for name, w := range DefaultLatencyWindows {
+		all[name] = h.Window(w).Summary()
+	}
+	return all
+}
+
+// Quantile estimates the q-th quantile by linear interpolation within buckets
+//
+// Observations in the +Inf bucket are reported as the largest bound
+func (s HistogramSnapshot) Quantile(q float64) time.Duration {
+	if s.Count == 0 || len(s.Bounds) == 0 {
+		return 0
+	}
+	rank := q * float64(s.Count)
+	var seen int64
+	for i, c := range s.Counts {
+		if c == 0 || float64(seen+c) < rank {
+			seen += c
+			continue
+		}
+		if i == len(s.Bounds) {
+			return s.Bounds[len(s.Bounds)-1]
+		}
+		var lower time.Duration
+		if i > 0 {
+			lower = s.Bounds[i-1]
+		}
+		upper := s.Bounds[i]
+		frac := (rank - float64(seen)) / float64(c)
+		return lower + time.Duration(frac*float64(upper-lower))
+	}
+	return s.Bounds[len(s.Bounds)-1]
+}
+
+func (s HistogramSnapshot) Summary() LatencySummary {
+	sum := LatencySummary{
+		Count: s.Count,
+		P50:   s.Quantile(0.50),
+		P95:   s.Quantile(0.95),
+		P99:   s.Quantile(0.99),
+	}
+	if s.Count > 0 {
+		sum.Mean = s.Sum / time.Duration(s.Count)
+	}
+	return sum
+}
@@ -0,0 +1,153 @@
+package relay
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/btwiuse/tags"
+)
+
+// reasons a record was removed, see Record.Reason
+const (
+	// the control stream ended without a CLOSE
+	ReasonEOF = "eof"
+	// the client sent CLOSE
+	ReasonClosed = "closed"
+	// the client asked to drain
+	ReasonDrained = "drained"
+	// another client took over the key
+	ReasonReplaced = "replaced"
+	// served no request for Store.IdleTimeout
+	ReasonIdle = "idle"
+	// connected for longer than Store.MaxLifetime
+	ReasonLifetime = "lifetime"
+	// stopped answering pings, see Heartbeat
+	ReasonHeartbeat = "heartbeat"
+	// the relay shut down
+	ReasonShutdown = "shutdown"
+)
+
+// ClosedRecord is what is left of a record after it was removed
+type ClosedRecord struct {
+	Key       string                  `json:"key"`
+	IP        string                  `json:"ip"`
+	Principal string                  `json:"principal,omitempty"`
+	Transport string                  `json:"transport"`
+	Tags      tags.Tags               `json:"tags"`
+	Since     time.Time               `json:"since"`
+	Closed    time.Time               `json:"closed"`
+	Reason    string                  `json:"reason"`
+	Stats     *TransportStatsSnapshot `json:"stats,omitempty"`
+}
+
+// History keeps the most recently closed records, oldest ones are forgotten first
+type History struct {
+	lock    sync.Mutex
+	size    int
+	next    int
+	entries []ClosedRecord
+}
+
+func NewHistory(size int) *History {
+	return &History{size: max(size, 0)}
+}
+
+// Add remembers rec as closed at t for reason
+func (h *History) Add(rec *Record, reason string, t time.Time) {
+	if h == nil || h.size == 0 {
+		return
+	}
+	c := ClosedRecord{
+		Key:       rec.Key,
+		IP:        rec.IP,
+		Principal: rec.Principal,
+		Transport: rec.Transport,
+		Tags:      rec.currentTags(),
+		Since:     rec.Since,
+		Closed:    t,
+		Reason:    reason,
+	}
+	if stats := rec.Stats(); stats != nil {
+		snap := stats.Snapshot()
+		c.Stats = &snap
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if len(h.entries) < h.size {
+		h.entries = append(h.entries, c)
+		return
+	}
+	h.entries[h.next] = c
+	h.next = (h.next + 1) % h.size
+}
+
+// Entries returns the remembered records, most recently closed first
+func (h *History) Entries() (all []ClosedRecord) {
+	if h == nil {
+		return nil
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	all = make([]ClosedRecord, 0, len(h.entries))
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		all = append(all, h.entries[(h.next+i)%len(h.entries)])
+	}
+	return
+}
+
+// closed sets the removal reason of recs and remembers them in s.History
+func (s *Store) closed(reason string, recs ...*Record) {
+	now := time.Now()
+	for _, rec := range recs {
+		s.Lock.Lock()
+		rec.mu.Lock()
+		rec.Reason = reason
+		rec.mu.Unlock()
+		s.Lock.Unlock()
+		s.Logger.Info("closed", "key", rec.Key, "ip", rec.IP, "reason", reason)
+		s.History.Add(rec, reason, now)
+	}
+}
+
+func (s *Store) ClosedRecords() []ClosedRecord {
+	return s.History.Entries()
+}
+
+// HistoryHandler lists recently closed records, filtered by key and tags
+//
+//	GET /?key=<key>&<tag>=<value>
+func (i *IngressHandler) HistoryHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	query := r.URL.Query()
+	key := query.Get("key")
+	query.Del("key")
+	filtered := []ClosedRecord{}
+	for _, c := range i.storage.ClosedRecords() {
+		if key != "" && c.Key != key {
+			continue
+		}
+		if (&Record{Tags: c.Tags}).Matches(query) {
+			filtered = append(filtered, c)
+		}
+	}
+	resp, err := tags.UnescapedJSONMarshalIndent(filtered, "  ")
+	if err != nil {
+		slog.Warn(fmt.Sprintf("json marshal failed: %s", err))
+		return
+	}
+	w.Write(resp)
+}
+
+// historySizeFromEnv reads HISTORY_SIZE, defaulting to 256
+func historySizeFromEnv() int {
+	n, err := strconv.Atoi(os.Getenv("HISTORY_SIZE"))
+	if err != nil {
+		return 256
+	}
+	return n
+}
@@ -1,6 +1,9 @@
 package relay
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -42,6 +45,10 @@ func (i *IngressHandler) Use(middlewares ...muxr.Middleware) {
 	i.Router.Use(middlewares...)
 }
 
+func (i *IngressHandler) GetRecord(h string) (*Record, bool) {
+	return i.storage.GetRecord(h)
+}
+
 func (i *IngressHandler) GetRoundTripper(h string) (http.RoundTripper, bool) {
 	rec, ok := i.storage.GetRecord(h)
 	if !ok {
@@ -67,60 +74,153 @@ func (i *IngressHandler) RecordsHandler(w http.ResponseWriter, r *http.Request)
 	w.Write(resp)
 }
 
+// AliasHandler serves the alias API relative to its mount point
+//
+//	GET    /          list all aliases
+//	GET    /{name}    get one alias
+//	PUT    /{name}    {"target": "<key>"}
+//	DELETE /{name}
+//
+// The legacy text format is still accepted on the mount point itself:
+//
+//	curl -X POST -d "<alias> <target>" http://localhost:8080/alias
+//	curl -X DELETE -d "<alias>" http://localhost:8080/alias
 func (i *IngressHandler) AliasHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(r.URL.Path, "/")
+	if name == "" {
+		switch r.Method {
+		case http.MethodGet:
+			i.getAliases(w, r)
+		case http.MethodPost, http.MethodPut:
+			i.setAliasLegacy(w, r)
+		case http.MethodDelete:
+			i.deleteAliasLegacy(w, r)
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		}
+		return
+	}
 	switch r.Method {
 	case http.MethodGet:
-		i.getAliases(w, r)
-	case http.MethodPost, http.MethodPut:
-		i.setAlias(w, r)
+		i.getAlias(w, r, name)
+	case http.MethodPut:
+		i.putAlias(w, r, name)
 	case http.MethodDelete:
-		i.deleteAlias(w, r)
+		i.deleteAlias(w, r, name)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
 	}
 }
 
+// AliasEntry is the json representation of a single alias
+type AliasEntry struct {
+	Alias  string `json:"alias"`
+	Target string `json:"target"`
+}
+
 func (i *IngressHandler) getAliases(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	all := i.storage.Aliases()
-	resp, err := tags.UnescapedJSONMarshalIndent(all, "  ")
+	writeJSON(w, http.StatusOK, i.storage.Aliases())
+}
+
+func (i *IngressHandler) getAlias(w http.ResponseWriter, r *http.Request, name string) {
+	name = strings.ToLower(ToIdna(name))
+	target, ok := i.storage.Aliases()[name]
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("%w: %s", ErrAliasNotFound, name))
+		return
+	}
+	writeJSON(w, http.StatusOK, AliasEntry{Alias: name, Target: target})
+}
+
+func (i *IngressHandler) putAlias(w http.ResponseWriter, r *http.Request, name string) {
+	var entry AliasEntry
+	if err := json.NewDecoder(r.Body).Decode(&entry); err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid json body: %w", err))
+		return
+	}
+	i.setAlias(w, name, entry.Target)
+}
+
+func (i *IngressHandler) setAlias(w http.ResponseWriter, name, target string) {
+	created, err := i.storage.SetAlias(name, target)
 	if err != nil {
-		slog.Warn(fmt.Sprintf("json marshal failed: %s", err))
+		writeJSONError(w, aliasErrorStatus(err), err)
 		return
 	}
-	w.Write(resp)
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	name, _ = NormalizeAlias(name)
+	writeJSON(w, status, AliasEntry{Alias: name, Target: target})
+}
+
+func (i *IngressHandler) deleteAlias(w http.ResponseWriter, r *http.Request, name string) {
+	if err := i.storage.RemoveAlias(name); err != nil {
+		writeJSONError(w, aliasErrorStatus(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
-// example curl request:
-// curl -X POST -d "<alias> <target>" http://localhost:8080/alias
-func (i *IngressHandler) setAlias(w http.ResponseWriter, r *http.Request) {
-	// get request body as string and split it into alias and target
+func (i *IngressHandler) setAliasLegacy(w http.ResponseWriter, r *http.Request) {
 	b, err := io.ReadAll(r.Body)
-	if err == nil {
-		line := strings.TrimSpace(string(b))
-		parts := strings.Split(line, " ")
-		if len(parts) == 2 {
-			alias, target := parts[0], parts[1]
-			i.storage.Alias(alias, target)
-		}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
 	}
+	parts := strings.Fields(string(b))
+	if len(parts) != 2 {
+		writeJSONError(w, http.StatusBadRequest, errors.New(`expected "<alias> <target>"`))
+		return
+	}
+	i.setAlias(w, parts[0], parts[1])
 }
 
-// example curl request:
-// curl -X DELETE -d "<alias>" http://localhost:8080/alias
-func (i *IngressHandler) deleteAlias(w http.ResponseWriter, r *http.Request) {
-	// get request body as string and split it into alias
+func (i *IngressHandler) deleteAliasLegacy(w http.ResponseWriter, r *http.Request) {
 	b, err := io.ReadAll(r.Body)
-	if err == nil {
-		alias := strings.TrimSpace(string(b))
-		i.storage.Unalias(alias)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	i.deleteAlias(w, r, strings.TrimSpace(string(b)))
+}
+
+func aliasErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidAlias):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrAliasNotFound), errors.Is(err, ErrTargetNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrAliasConflict), errors.Is(err, ErrAliasCycle):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
 	}
 }
 
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	resp, err := tags.UnescapedJSONMarshalIndent(v, "  ")
+	if err != nil {
+		slog.Warn(fmt.Sprintf("json marshal failed: %s", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(resp)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
 func (i *IngressHandler) Dispatch(r *http.Request) http.Handler {
-	rt, ok := i.GetRoundTripper(r.Host)
+	rec, ok := i.GetRecord(r.Host)
 	if !ok {
 		return utils.HostNotFoundHandler()
 	}
-	rp := utils.LoggedReverseProxy(rt)
+	rp := utils.LoggedReverseProxy(rec.RoundTripper)
 	rp.Rewrite = func(req *httputil.ProxyRequest) {
 		req.SetXForwarded()
 		req.Out.URL.Host = r.Host
@@ -130,7 +230,7 @@ func (i *IngressHandler) Dispatch(r *http.Request) http.Handler {
 		expvars.WebteleportRelayStreamsClosed.Add(1)
 		return nil
 	}
-	return rp
+	return rec.Policy.Handler(rec.Limiters.Handler(rp))
 }
 
 func (i *IngressHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -140,3 +240,11 @@ func (i *IngressHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func (i *IngressHandler) Subscribe(upgrader edge.Upgrader) {
 	i.storage.Subscribe(upgrader)
 }
+
+func (i *IngressHandler) SubscribeContext(ctx context.Context, upgrader edge.Upgrader) error {
+	return i.storage.SubscribeContext(ctx, upgrader)
+}
+
+func (i *IngressHandler) Shutdown(ctx context.Context) error {
+	return i.storage.Shutdown(ctx)
+}
@@ -0,0 +1,331 @@
+package relay
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Limits caps the traffic of a tunnel, zero values mean unlimited
+//
+// The relay sets the ceiling, clients may only lower it with tags:
+//
+//	?rps=<requests per second>&concurrency=<requests or streams>&bps=<bytes per second>
+type Limits struct {
+	RequestsPerSecond float64 `json:"requestsPerSecond,omitempty"`
+	MaxConcurrent     int64   `json:"maxConcurrent,omitempty"`
+	// applied to each direction separately
+	BytesPerSecond float64 `json:"bytesPerSecond,omitempty"`
+}
+
+// Lower returns l tightened by the rps, concurrency and bps tags of v
+func (l Limits) Lower(v url.Values) (Limits, error) {
+	lower := func(limit float64, tag string) (float64, error) {
+		s := v.Get(tag)
+		if s == "" {
+			return limit, nil
+		}
+		x, err := strconv.ParseFloat(s, 64)
+		if err != nil || x <= 0 {
+			return 0, fmt.Errorf("invalid %s %q", tag, s)
+		}
+		if limit == 0 || x < limit {
+			return x, nil
+		}
+		return limit, nil
+	}
+	var err error
+	if l.RequestsPerSecond, err = lower(l.RequestsPerSecond, "rps"); err != nil {
+		return l, err
+	}
+	concurrent, err := lower(float64(l.MaxConcurrent), "concurrency")
+	if err != nil {
+		return l, err
+	}
+	l.MaxConcurrent = int64(concurrent)
+	if l.BytesPerSecond, err = lower(l.BytesPerSecond, "bps"); err != nil {
+		return l, err
+	}
+	return l, nil
+}
+
+func (l Limits) IsZero() bool {
+	return l == Limits{}
+}
+
+// Limiter enforces Limits, it is safe for concurrent use
+type Limiter struct {
+	Limits
+	requests *tokenBucket
+	in       *tokenBucket
+	out      *tokenBucket
+	active   atomic.Int64
+	// records sharing a per ip limiter, guarded by Store.Lock
+	refs int
+}
+
+// NewLimiter returns nil if l is unlimited
+func NewLimiter(l Limits) *Limiter {
+	if l.IsZero() {
+		return nil
+	}
+	return &Limiter{
+		Limits:   l,
+		requests: newTokenBucket(l.RequestsPerSecond, max(l.RequestsPerSecond, 1)),
+		in:       newTokenBucket(l.BytesPerSecond, l.BytesPerSecond),
+		out:      newTokenBucket(l.BytesPerSecond, l.BytesPerSecond),
+	}
+}
+
+// Limiters combines the limiter of a record with the one shared by its client ip
+type Limiters []*Limiter
+
+// Acquire admits a request or stream against every limiter, or none of them
+func (ls Limiters) Acquire() (release func(), ok bool) {
+	acquired := Limiters{}
+	release = func() {
+		for _, l := range acquired {
+			l.active.Add(-1)
+		}
+	}
+	for _, l := range ls {
+		if l == nil {
+			continue
+		}
+		if l.MaxConcurrent > 0 && l.active.Add(1) > l.MaxConcurrent {
+			l.active.Add(-1)
+			release()
+			return nil, false
+		}
+		if l.MaxConcurrent > 0 {
+			acquired = append(acquired, l)
+		}
+		if !l.requests.allow() {
+			release()
+			return nil, false
+		}
+	}
+	return release, true
+}
+
+// Reader throttles bytes flowing into the tunnel
+func (ls Limiters) Reader(r io.Reader) io.Reader {
+	return &throttledReader{r: r, buckets: ls.buckets(func(l *Limiter) *tokenBucket { return l.in })}
+}
+
+// Writer throttles bytes flowing out of the tunnel
+func (ls Limiters) Writer(w io.Writer) io.Writer {
+	return &throttledWriter{w: w, buckets: ls.buckets(func(l *Limiter) *tokenBucket { return l.out })}
+}
+
+func (ls Limiters) buckets(f func(*Limiter) *tokenBucket) (buckets []*tokenBucket) {
+	for _, l := range ls {
+		if l != nil && l.BytesPerSecond > 0 {
+			buckets = append(buckets, f(l))
+		}
+	}
+	return
+}
+
+// Handler answers 429 when a request exceeds the limits, and throttles bodies
+func (ls Limiters) Handler(next http.Handler) http.Handler {
+	if len(ls) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		release, ok := ls.Acquire()
+		if !ok {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		defer release()
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = readCloser{ls.Reader(r.Body), r.Body}
+		}
+		next.ServeHTTP(&throttledResponseWriter{ResponseWriter: w, w: ls.Writer(w), ls: ls}, r)
+	})
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type throttledReader struct {
+	r       io.Reader
+	buckets []*tokenBucket
+}
+
+func (t *throttledReader) Read(p []byte) (n int, err error) {
+	n, err = t.r.Read(p)
+	for _, b := range t.buckets {
+		b.wait(n)
+	}
+	return
+}
+
+type throttledWriter struct {
+	w       io.Writer
+	buckets []*tokenBucket
+}
+
+func (t *throttledWriter) Write(p []byte) (n int, err error) {
+	for _, b := range t.buckets {
+		b.wait(len(p))
+	}
+	return t.w.Write(p)
+}
+
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	w  io.Writer
+	ls Limiters
+}
+
+func (t *throttledResponseWriter) Write(p []byte) (int, error) {
+	return t.w.Write(p)
+}
+
+// Hijack throttles the connections of upgraded requests, such as websockets
+// proxied by httputil.ReverseProxy, in both directions
+func (t *throttledResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(t.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	// bytes the server already buffered are read through brw first
+	tc := &throttledConn{Conn: conn, r: t.ls.Reader(brw), w: t.ls.Writer(conn)}
+	return tc, bufio.NewReadWriter(bufio.NewReader(tc), bufio.NewWriter(tc)), nil
+}
+
+// Unwrap lets http.ResponseController reach Flush
+func (t *throttledResponseWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// throttledConn is a hijacked connection subject to Limiters
+type throttledConn struct {
+	net.Conn
+	r io.Reader
+	w io.Writer
+}
+
+func (c *throttledConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *throttledConn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+// tokenBucket refills at rate tokens per second up to burst, a zero rate never limits
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// allow takes a token if one is available
+func (b *tokenBucket) allow() bool {
+	if b == nil || b.rate == 0 {
+		return true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// wait takes n tokens, sleeping until the debt they create is paid back
+func (b *tokenBucket) wait(n int) {
+	if b == nil || b.rate == 0 || n <= 0 {
+		return
+	}
+	b.lock.Lock()
+	b.refill()
+	b.tokens -= float64(n)
+	debt := -b.tokens
+	b.lock.Unlock()
+	if debt > 0 {
+		time.Sleep(time.Duration(debt / b.rate * float64(time.Second)))
+	}
+}
+
+// attachLimitersLocked gives rec its own limiter and the one shared by its client ip,
+// caller must hold s.Lock
+func (s *Store) attachLimitersLocked(rec *Record) {
+	rec.Limiters = nil
+	if l := NewLimiter(rec.Limits); l != nil {
+		rec.Limiters = append(rec.Limiters, l)
+	}
+	if s.IPLimits.IsZero() {
+		return
+	}
+	l, ok := s.IPLimiters[rec.IP]
+	if !ok {
+		l = NewLimiter(s.IPLimits)
+		s.IPLimiters[rec.IP] = l
+	}
+	l.refs++
+	rec.Limiters = append(rec.Limiters, l)
+}
+
+// detachLimitersLocked drops the per ip limiter of rec once no record uses it,
+// caller must hold s.Lock
+func (s *Store) detachLimitersLocked(rec *Record) {
+	l, ok := s.IPLimiters[rec.IP]
+	if !ok {
+		return
+	}
+	for _, rl := range rec.Limiters {
+		if rl != l {
+			continue
+		}
+		if l.refs--; l.refs <= 0 {
+			delete(s.IPLimiters, rec.IP)
+		}
+		return
+	}
+}
+
+// limitsFromEnv reads <prefix>RPS, <prefix>CONCURRENCY and <prefix>BPS
+func limitsFromEnv(prefix string) (l Limits) {
+	parse := func(key string) float64 {
+		x, _ := strconv.ParseFloat(os.Getenv(prefix+key), 64)
+		return max(x, 0)
+	}
+	l.RequestsPerSecond = parse("RPS")
+	l.MaxConcurrent = int64(parse("CONCURRENCY"))
+	l.BytesPerSecond = parse("BPS")
+	return
+}
@@ -0,0 +1,53 @@
+package relay
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// upgraded connections must stay subject to bps limits after a hijack
+func TestLimitersHijack(t *testing.T) {
+	ls := Limiters{NewLimiter(Limits{BytesPerSecond: 1 << 20})}
+	throttled := make(chan bool, 1)
+	srv := httptest.NewServer(ls.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			throttled <- false
+			return
+		}
+		defer conn.Close()
+		_, ok := conn.(*throttledConn)
+		throttled <- ok
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n\r\n")
+		brw.Flush()
+		line, _ := brw.ReadString('\n')
+		io.WriteString(conn, line)
+	})))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\nping\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	if line, _ := br.ReadString('\n'); line != "ping\n" {
+		t.Errorf("echoed %q, want the bytes sent along with the request", line)
+	}
+	if !<-throttled {
+		t.Error("hijacked connection is not throttled")
+	}
+}
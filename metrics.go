@@ -4,11 +4,38 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // TransportStats contains various transport-level statistics
+//
+// Fields are updated concurrently, use Snapshot to read them
 type TransportStats struct {
+	// bytes written into upgraded connections
+	BytesSent atomic.Int64
+	// bytes read from request and response bodies and upgraded connections
+	BytesReceived  atomic.Int64
+	RequestCount   atomic.Int64
+	ResponseCount  atomic.Int64
+	FailedRequests atomic.Int64
+	// requests until their response body is done, upgraded connections until closed
+	ActiveRequests atomic.Int64
+	// durations in nanoseconds
+	TotalRequestDuration atomic.Int64
+	MaxRequestDuration   atomic.Int64
+	MinRequestDuration   atomic.Int64
+	// unix nanoseconds, zero if no request has been made
+	LastRequestTime atomic.Int64
+	// distribution of time until response headers arrive, nil to disable
+	TimeToFirstByte *Histogram
+	// distribution of time until the response body is done, nil to disable
+	RequestDurations *Histogram
+}
+
+// TransportStatsSnapshot is a point-in-time copy of TransportStats
+type TransportStatsSnapshot struct {
 	BytesSent            int64         `json:"bytesSent"`
 	BytesReceived        int64         `json:"bytesReceived"`
 	RequestCount         int64         `json:"requestCount"`
@@ -19,6 +46,61 @@ type TransportStats struct {
 	LastRequestTime      time.Time     `json:"lastRequestTime,omitempty"`
 	MaxRequestDuration   time.Duration `json:"maxRequestDuration,omitempty"`
 	MinRequestDuration   time.Duration `json:"minRequestDuration,omitempty"`
+	// keyed by window: 1m, 5m, 1h and all
+	TimeToFirstByte map[string]LatencySummary `json:"timeToFirstByte,omitempty"`
+	RequestDuration map[string]LatencySummary `json:"requestDuration,omitempty"`
+}
+
+// Snapshot returns a copy of the current statistics
+func (s *TransportStats) Snapshot() TransportStatsSnapshot {
+	snap := TransportStatsSnapshot{
+		BytesSent:            s.BytesSent.Load(),
+		BytesReceived:        s.BytesReceived.Load(),
+		RequestCount:         s.RequestCount.Load(),
+		ResponseCount:        s.ResponseCount.Load(),
+		FailedRequests:       s.FailedRequests.Load(),
+		ActiveRequests:       s.ActiveRequests.Load(),
+		TotalRequestDuration: time.Duration(s.TotalRequestDuration.Load()),
+		MaxRequestDuration:   time.Duration(s.MaxRequestDuration.Load()),
+		MinRequestDuration:   time.Duration(s.MinRequestDuration.Load()),
+	}
+	if last := s.LastRequestTime.Load(); last != 0 {
+		snap.LastRequestTime = time.Unix(0, last)
+	}
+	if s.TimeToFirstByte != nil {
+		snap.TimeToFirstByte = s.TimeToFirstByte.Summaries()
+	}
+	if s.RequestDurations != nil {
+		snap.RequestDuration = s.RequestDurations.Summaries()
+	}
+	return snap
+}
+
+// observe records the time until response headers arrived
+func (s *TransportStats) observe(d time.Duration) {
+	if s.TimeToFirstByte != nil {
+		s.TimeToFirstByte.Observe(d)
+	}
+	s.TotalRequestDuration.Add(int64(d))
+	s.LastRequestTime.Store(time.Now().UnixNano())
+	for {
+		max := s.MaxRequestDuration.Load()
+		if max != 0 && int64(d) <= max {
+			break
+		}
+		if s.MaxRequestDuration.CompareAndSwap(max, int64(d)) {
+			break
+		}
+	}
+	for {
+		min := s.MinRequestDuration.Load()
+		if min != 0 && int64(d) >= min {
+			break
+		}
+		if s.MinRequestDuration.CompareAndSwap(min, int64(d)) {
+			break
+		}
+	}
 }
 
 // MetricsTransport wraps http.Transport to collect various HTTP metrics
@@ -30,24 +112,24 @@ type MetricsTransport struct {
 // metricReader wraps an io.Reader to count bytes read
 type metricReader struct {
 	r     io.Reader
-	count *int64
+	count *atomic.Int64
 }
 
 func (r *metricReader) Read(p []byte) (n int, err error) {
 	n, err = r.r.Read(p)
-	*r.count += int64(n)
+	r.count.Add(int64(n))
 	return
 }
 
 // metricWriter wraps an io.Writer to count bytes written
 type metricWriter struct {
 	w     io.Writer
-	count *int64
+	count *atomic.Int64
 }
 
 func (w *metricWriter) Write(p []byte) (n int, err error) {
 	n, err = w.w.Write(p)
-	*w.count += int64(n)
+	w.count.Add(int64(n))
 	return
 }
 
@@ -72,8 +154,40 @@ func (rw *metricsReadWriteCloser) Close() error {
 	return rw.closer.Close()
 }
 
+// timedBody calls done once, when the body is read to EOF or closed
+type timedBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *timedBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.once.Do(b.done)
+	}
+	return
+}
+
+func (b *timedBody) Close() error {
+	b.once.Do(b.done)
+	return b.ReadCloser.Close()
+}
+
+// upgradedBody calls done once, when the upgraded connection is closed
+type upgradedBody struct {
+	io.ReadWriteCloser
+	once sync.Once
+	done func()
+}
+
+func (b *upgradedBody) Close() error {
+	b.once.Do(b.done)
+	return b.ReadWriteCloser.Close()
+}
+
 // wrapBody wraps a body with metrics tracking, handling both ReadCloser and ReadWriteCloser cases
-func wrapBody(body io.ReadCloser, readCount, writeCount *int64) io.ReadCloser {
+func wrapBody(body io.ReadCloser, readCount, writeCount *atomic.Int64) io.ReadCloser {
 	if rwc, ok := body.(io.ReadWriteCloser); ok {
 		return &metricsReadWriteCloser{
 			metricReader: metricReader{r: rwc, count: readCount},
@@ -94,14 +208,16 @@ func NewMetricsTransport(wrapped http.RoundTripper) *MetricsTransport {
 	}
 	return &MetricsTransport{
 		Transport: wrapped,
-		Stats:     &TransportStats{},
+		Stats: &TransportStats{
+			TimeToFirstByte:  NewHistogram(DefaultDurationBuckets),
+			RequestDurations: NewHistogram(DefaultDurationBuckets),
+		},
 	}
 }
 
 // RoundTrip implements the http.RoundTripper interface
 func (t *MetricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	t.Stats.ActiveRequests++
-	defer func() { t.Stats.ActiveRequests-- }()
+	t.Stats.ActiveRequests.Add(1)
 
 	startTime := time.Now()
 
@@ -109,30 +225,39 @@ func (t *MetricsTransport) RoundTrip(req *http.Request) (*http.Response, error)
 	if req.Body != nil {
 		req.Body = wrapBody(req.Body, &t.Stats.BytesReceived, &t.Stats.BytesSent)
 	}
-	t.Stats.RequestCount++
+	t.Stats.RequestCount.Add(1)
 
 	// Perform the request
 	resp, err := t.Transport.RoundTrip(req)
 
-	// Calculate request duration
-	duration := time.Since(startTime)
-	t.Stats.TotalRequestDuration += duration
-	t.Stats.LastRequestTime = time.Now()
-
-	// Update min/max request times
-	if t.Stats.MaxRequestDuration == 0 || duration > t.Stats.MaxRequestDuration {
-		t.Stats.MaxRequestDuration = duration
-	}
-	if t.Stats.MinRequestDuration == 0 || duration < t.Stats.MinRequestDuration {
-		t.Stats.MinRequestDuration = duration
-	}
+	// Update total/last/min/max request times
+	t.Stats.observe(time.Since(startTime))
 
 	if err != nil {
-		t.Stats.FailedRequests++
+		t.Stats.ActiveRequests.Add(-1)
+		t.Stats.FailedRequests.Add(1)
 		return nil, err
 	}
 
-	t.Stats.ResponseCount++
+	t.Stats.ResponseCount.Add(1)
+
+	// The request stays active until its body is done, so that draining waits
+	// for streamed responses. Upgraded connections stay open indefinitely, so
+	// only time regular bodies.
+	finish := func() { t.Stats.ActiveRequests.Add(-1) }
+	if rwc, ok := resp.Body.(io.ReadWriteCloser); ok && resp.StatusCode == http.StatusSwitchingProtocols {
+		resp.Body = &upgradedBody{ReadWriteCloser: rwc, done: finish}
+	} else {
+		resp.Body = &timedBody{
+			ReadCloser: resp.Body,
+			done: func() {
+				if t.Stats.RequestDurations != nil {
+					t.Stats.RequestDurations.Observe(time.Since(startTime))
+				}
+				finish()
+			},
+		}
+	}
 
 	// Wrap the response body
 	resp.Body = wrapBody(resp.Body, &t.Stats.BytesReceived, &t.Stats.BytesSent)
@@ -142,10 +267,10 @@ func (t *MetricsTransport) RoundTrip(req *http.Request) (*http.Response, error)
 
 // MarshalJSON implements the json.Marshaler interface
 func (t *MetricsTransport) MarshalJSON() ([]byte, error) {
-	return json.Marshal(t.Stats)
+	return json.Marshal(t.Stats.Snapshot())
 }
 
 // MarshalJSONIndent returns an indented JSON representation
 func (t *MetricsTransport) MarshalJSONIndent(prefix, indent string) ([]byte, error) {
-	return json.MarshalIndent(t.Stats, prefix, indent)
+	return json.MarshalIndent(t.Stats.Snapshot(), prefix, indent)
 }
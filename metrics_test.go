@@ -0,0 +1,172 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// echoTransport drains the request body and answers with a fixed body,
+// failing every request that carries the fail header
+type echoTransport struct {
+	body string
+}
+
+func (t echoTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		if _, err := io.Copy(io.Discard, req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+	if req.Header.Get("fail") != "" {
+		return nil, errors.New("failed")
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(t.body)),
+		Request:    req,
+	}, nil
+}
+
+// run with -race, the counters are hammered while being read
+func TestMetricsTransportConcurrent(t *testing.T) {
+	const (
+		workers  = 16
+		requests = 200
+		reqBody  = "ping"
+		respBody = "pong pong"
+	)
+	mt := NewMetricsTransport(echoTransport{body: respBody})
+
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	for range 4 {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				snap := mt.Stats.Snapshot()
+				if snap.ActiveRequests < 0 || snap.ActiveRequests > workers {
+					t.Errorf("active requests out of range: %d", snap.ActiveRequests)
+				}
+				if _, err := json.Marshal(mt); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+
+	var writers sync.WaitGroup
+	for w := range workers {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			for i := range requests {
+				req, _ := http.NewRequest(http.MethodPost, "http://example.com", strings.NewReader(reqBody))
+				if (w+i)%10 == 0 {
+					req.Header.Set("fail", "1")
+				}
+				resp, err := mt.RoundTrip(req)
+				if err != nil {
+					continue
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+		}()
+	}
+	writers.Wait()
+	close(stop)
+	readers.Wait()
+
+	snap := mt.Stats.Snapshot()
+	total := int64(workers * requests)
+	failed := total / 10
+	if snap.RequestCount != total {
+		t.Errorf("request count: got %d, want %d", snap.RequestCount, total)
+	}
+	if snap.FailedRequests != failed {
+		t.Errorf("failed requests: got %d, want %d", snap.FailedRequests, failed)
+	}
+	if snap.ResponseCount != total-failed {
+		t.Errorf("response count: got %d, want %d", snap.ResponseCount, total-failed)
+	}
+	if snap.ActiveRequests != 0 {
+		t.Errorf("active requests: got %d, want 0", snap.ActiveRequests)
+	}
+	wantBytes := total*int64(len(reqBody)) + (total-failed)*int64(len(respBody))
+	if snap.BytesReceived != wantBytes {
+		t.Errorf("bytes received: got %d, want %d", snap.BytesReceived, wantBytes)
+	}
+	if got := snap.RequestDuration["all"].Count; got != total-failed {
+		t.Errorf("request durations: got %d, want %d", got, total-failed)
+	}
+	if got := snap.TimeToFirstByte["all"].Count; got != total {
+		t.Errorf("time to first byte: got %d, want %d", got, total)
+	}
+}
+
+// upgradeTransport answers 101 with a connection as the body
+type upgradeTransport struct{}
+
+func (upgradeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	conn, peer := net.Pipe()
+	go io.Copy(io.Discard, peer)
+	return &http.Response{
+		StatusCode: http.StatusSwitchingProtocols,
+		Body:       conn,
+		Request:    req,
+	}, nil
+}
+
+// a request is active until its body is done, so that draining waits for it
+func TestMetricsTransportActiveUntilBodyDone(t *testing.T) {
+	for name, transport := range map[string]http.RoundTripper{
+		"streamed": echoTransport{body: "pong"},
+		"upgraded": upgradeTransport{},
+	} {
+		t.Run(name, func(t *testing.T) {
+			mt := NewMetricsTransport(transport)
+			rec := &Record{RoundTripper: mt}
+			req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+			resp, err := mt.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := mt.Stats.ActiveRequests.Load(); got != 1 {
+				t.Errorf("active requests with the body open: got %d, want 1", got)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			if err := waitIdle(ctx, rec); err == nil {
+				t.Error("waitIdle returned while the body was open")
+			}
+			if name == "upgraded" {
+				if _, ok := resp.Body.(io.Writer); !ok {
+					t.Error("upgraded body is no longer writable")
+				}
+			}
+			resp.Body.Close()
+			resp.Body.Close()
+			if got := mt.Stats.ActiveRequests.Load(); got != 0 {
+				t.Errorf("active requests after close: got %d, want 0", got)
+			}
+			if err := waitIdle(context.Background(), rec); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
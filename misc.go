@@ -46,8 +46,23 @@ func (s *WSServer) RootInternalHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if aliases := os.Getenv("INTERNAL_ALIASES_PATH"); aliases != "" && r.URL.Path == aliases {
-		s.AliasHandler(w, r)
+	if metrics := os.Getenv("INTERNAL_METRICS_PATH"); metrics != "" && r.URL.Path == metrics {
+		s.MetricsHandler(w, r)
+		return
+	}
+
+	if events := os.Getenv("INTERNAL_EVENTS_PATH"); events != "" && r.URL.Path == events {
+		s.EventsHandler(w, r)
+		return
+	}
+
+	if history := os.Getenv("INTERNAL_HISTORY_PATH"); history != "" && r.URL.Path == history {
+		s.HistoryHandler(w, r)
+		return
+	}
+
+	if aliases := os.Getenv("INTERNAL_ALIASES_PATH"); aliases != "" && (r.URL.Path == aliases || strings.HasPrefix(r.URL.Path, aliases+"/")) {
+		http.StripPrefix(aliases, http.HandlerFunc(s.AliasHandler)).ServeHTTP(w, r)
 		return
 	}
 
@@ -68,13 +83,13 @@ func (s *WSServer) RootHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	rpath := leadingComponent(r.URL.Path)
-	rt, ok := s.GetRoundTripper(rpath)
+	rec, ok := s.GetRecord(rpath)
 	if !ok {
 		DefaultIndex().ServeHTTP(w, r)
 		return
 	}
 
-	rp := utils.LoggedReverseProxy(rt)
+	rp := utils.LoggedReverseProxy(rec.RoundTripper)
 	rp.Rewrite = func(req *httputil.ProxyRequest) {
 		req.SetXForwarded()
 
@@ -84,6 +99,6 @@ func (s *WSServer) RootHandler(w http.ResponseWriter, r *http.Request) {
 		// so setting this field currently doesn't have any effect
 		req.Out.URL.Scheme = "http"
 	}
-	http.StripPrefix("/"+rpath, rp).ServeHTTP(w, r)
+	http.StripPrefix("/"+rpath, rec.Policy.Handler(rec.Limiters.Handler(rp))).ServeHTTP(w, r)
 	expvars.WebteleportRelayStreamsClosed.Add(1)
 }
@@ -0,0 +1,93 @@
+package relay
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/webteleport/webteleport/edge"
+)
+
+// ErrKeyOwned is returned by Upsert when the key is held by a different public key
+var ErrKeyOwned = errors.New("key is held by a different public key")
+
+// edgePublicKey returns the ed25519 public key presented by the client
+// in the pubkey query parameter, encoded as unpadded base64url
+func edgePublicKey(r *edge.Edge) (ed25519.PublicKey, error) {
+	v := r.Values.Get("pubkey")
+	if v == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pubkey: %w", err)
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid pubkey: want %d bytes, got %d", ed25519.PublicKeySize, len(b))
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+// VerifyOwnership asks a client presenting a public key to sign a fresh challenge
+//
+//	relay:  CHALLENGE <hex nonce>
+//	client: SIGNATURE <base64url ed25519 signature of the hex nonce>
+//
+// Clients without a public key are not challenged
+func (s *Store) VerifyOwnership(r *edge.Edge) error {
+	pub, err := edgePublicKey(r)
+	if err != nil || pub == nil {
+		return err
+	}
+
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	challenge := hex.EncodeToString(nonce)
+	if err := NewControl(r).Send(ControlMessage{Type: "challenge", Nonce: challenge}); err != nil {
+		return err
+	}
+
+	_ = r.Stream.SetReadDeadline(time.Now().Add(s.ChallengeTimeout))
+	defer r.Stream.SetReadDeadline(time.Time{})
+	line, err := readLine(r.Stream)
+	if err != nil {
+		return fmt.Errorf("read signature: %w", err)
+	}
+	m, err := ParseControlMessage(line)
+	if err != nil || m.Type != "signature" {
+		return fmt.Errorf("expected SIGNATURE, got %q", line)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(m.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %w", err)
+	}
+	if !ed25519.Verify(pub, []byte(challenge), sig) {
+		return errors.New("signature verification failed")
+	}
+	return nil
+}
+
+// readLine reads a single line one byte at a time, so that nothing
+// past the newline is consumed before Scan takes over the stream
+func readLine(r io.Reader) (string, error) {
+	var sb strings.Builder
+	b := make([]byte, 1)
+	for sb.Len() < 1024 {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return strings.TrimSuffix(sb.String(), "\r"), nil
+		}
+		sb.WriteByte(b[0])
+	}
+	return "", errors.New("line too long")
+}
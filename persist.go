@@ -0,0 +1,242 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Journal persists aliases and record metadata to a json file on disk,
+// so that they survive relay restarts
+type Journal struct {
+	Path  string
+	lock  sync.Mutex
+	dirty chan struct{}
+}
+
+// JournalState is the on-disk layout of a Journal
+type JournalState struct {
+	Aliases map[string]string         `json:"aliases"`
+	Records map[string]*JournalRecord `json:"records"`
+}
+
+// JournalRecord is the persisted subset of a Record
+//
+// Sessions can not be persisted, so only metadata survives a restart
+type JournalRecord struct {
+	Key    string     `json:"key"`
+	Header url.Values `json:"header"`
+	Tags   url.Values `json:"tags"`
+	Since  time.Time  `json:"since"`
+	IP     string     `json:"ip"`
+	Path   string     `json:"path"`
+	// last time the record was live, it is forgotten after Store.PersistTTL
+	Seen time.Time `json:"seen"`
+}
+
+// expired reports whether r went offline more than ttl before now, zero ttl never expires
+func (r *JournalRecord) expired(now time.Time, ttl time.Duration) bool {
+	if ttl <= 0 {
+		return false
+	}
+	seen := r.Seen
+	if seen.IsZero() {
+		seen = r.Since
+	}
+	return now.Sub(seen) > ttl
+}
+
+func NewJournal(path string) *Journal {
+	return &Journal{Path: path, dirty: make(chan struct{}, 1)}
+}
+
+// Load reads the journal file, a missing file yields an empty state
+func (j *Journal) Load() (*JournalState, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	state := &JournalState{
+		Aliases: map[string]string{},
+		Records: map[string]*JournalRecord{},
+	}
+	b, err := os.ReadFile(j.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Save atomically replaces the journal file with state
+func (j *Journal) Save(state *JournalState) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.save(state)
+}
+
+// Sync saves state(), which is evaluated under the journal lock so that
+// concurrent syncs never overwrite a newer state with an older one
+func (j *Journal) Sync(state func() *JournalState) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.save(state())
+}
+
+// Notify asks the writer started by Run to sync, without waiting for the
+// disk, notifications arriving while a sync is pending coalesce into it
+func (j *Journal) Notify() {
+	select {
+	case j.dirty <- struct{}{}:
+	default:
+	}
+}
+
+// Run syncs state() after every Notify until ctx is done
+func (j *Journal) Run(ctx context.Context, state func() *JournalState, logger *slog.Logger) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-j.dirty:
+		}
+		if err := j.Sync(state); err != nil {
+			logger.Warn("save journal failed", "path", j.Path, "error", err)
+		}
+	}
+}
+
+func (j *Journal) save(state *JournalState) error {
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(j.Path), filepath.Base(j.Path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), j.Path)
+}
+
+// NewPersistentStore returns a Store whose aliases and record metadata
+// are reloaded from and written back to the journal file at path
+func NewPersistentStore(path string) (*Store, error) {
+	j := NewJournal(path)
+	state, err := j.Load()
+	if err != nil {
+		return nil, err
+	}
+	s := NewStore()
+	s.AliasMap = state.Aliases
+	s.Persisted = state.Records
+	s.Journal = j
+	s.OnUpdateFunc = func(*Store) {
+		j.Notify()
+	}
+	logger := s.Logger
+	s.background(func(ctx context.Context) {
+		j.Run(ctx, s.JournalState, logger)
+	})
+	return s, nil
+}
+
+// prunePersistedLocked forgets persisted records older than s.PersistTTL,
+// caller must hold s.Lock
+func (s *Store) prunePersistedLocked(now time.Time) {
+	for k, rec := range s.Persisted {
+		if rec.expired(now, s.PersistTTL) {
+			delete(s.Persisted, k)
+		}
+	}
+}
+
+// JournalState returns a snapshot of the store suitable for persisting
+//
+// Records persisted earlier are kept until a live record replaces them
+func (s *Store) JournalState() *JournalState {
+	s.Lock.RLock()
+	defer s.Lock.RUnlock()
+	state := &JournalState{
+		Aliases: map[string]string{},
+		Records: map[string]*JournalRecord{},
+	}
+	// granted hostnames go away with their records, they must not outlive a crash
+	granted := s.grantedLocked()
+	for k, v := range s.AliasMap {
+		if !granted[k] {
+			state.Aliases[k] = v
+		}
+	}
+	now := time.Now()
+	for k, rec := range s.Persisted {
+		if !rec.expired(now, s.PersistTTL) {
+			state.Records[k] = rec
+		}
+	}
+	for k, rec := range s.RecordMap {
+		state.Records[k] = newJournalRecord(rec, now)
+	}
+	return state
+}
+
+// newJournalRecord returns the persisted subset of rec, last seen at seen,
+// caller must hold s.Lock
+func newJournalRecord(rec *Record, seen time.Time) *JournalRecord {
+	return &JournalRecord{
+		Key:    rec.Key,
+		Header: rec.Header.Values,
+		Tags:   rec.Tags.Values,
+		Since:  rec.Since,
+		IP:     rec.IP,
+		Path:   rec.Path,
+		Seen:   seen,
+	}
+}
+
+// persistLocked keeps the metadata of rec, whose key is no longer served,
+// until its client comes back or s.PersistTTL passes, caller must hold s.Lock
+func (s *Store) persistLocked(rec *Record) {
+	if s.Journal == nil {
+		return
+	}
+	s.Persisted[rec.Key] = newJournalRecord(rec, time.Now())
+}
+
+// persistedPort returns the tcp key previously held by a client with the same path
+func (s *Store) persistedPort(path string) (string, bool) {
+	s.Lock.RLock()
+	defer s.Lock.RUnlock()
+	for k, rec := range s.Persisted {
+		if rec.expired(time.Now(), s.PersistTTL) {
+			continue
+		}
+		if rec.Path == path && rec.Tags.Get("protocol") == "tcp" {
+			if _, live := s.RecordMap[k]; !live {
+				return k, true
+			}
+		}
+	}
+	return "", false
+}
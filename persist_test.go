@@ -0,0 +1,127 @@
+package relay
+
+import (
+	"context"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/webteleport/webteleport/edge"
+)
+
+// client connects to a persistent relay, the relay exits, the relay
+// restarts and the client reconnects to the port it had
+func TestPersistAcrossShutdown(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.json")
+	s, err := NewPersistentStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &edge.Edge{
+		Session: newFakeSession(),
+		Stream:  newTestStream(),
+		Path:    "/client",
+		Values:  url.Values{"protocol": {"tcp"}},
+		RealIP:  "127.0.0.1",
+	}
+	k, err := s.allocateTCP(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.upsert(k, r, "", NewControl(r)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := NewPersistentStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restarted.Persisted[k]; !ok {
+		t.Fatalf("record %s was not persisted: %v", k, restarted.Persisted)
+	}
+	r.Session = newFakeSession()
+	r.Stream = newTestStream()
+	reclaimed, err := restarted.allocateTCP(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reclaimed != k {
+		t.Errorf("reconnected to %s, want %s", reclaimed, k)
+	}
+	if _, err := restarted.upsert(reclaimed, r, "", NewControl(r)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restarted.Persisted[k]; ok {
+		t.Errorf("record %s is still persisted after it was reclaimed", k)
+	}
+	_ = restarted.Shutdown(context.Background())
+}
+
+// a client disconnecting is remembered, not forgotten on the next save
+func TestPersistOnDisconnect(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.json")
+	s, err := NewPersistentStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+	rec := addTestRecord(s, "client")
+	s.RemoveSession(rec.Session)
+	if err := s.Journal.Sync(s.JournalState); err != nil {
+		t.Fatal(err)
+	}
+	state, err := s.Journal.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state.Records["client"]; !ok {
+		t.Errorf("disconnected record was dropped from the journal: %v", state.Records)
+	}
+}
+
+// hostnames granted over the control stream are neither persisted nor
+// left behind by a shutdown, operator aliases are kept
+func TestPersistSkipsHostnames(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.json")
+	s, err := NewPersistentStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := addTestRecord(s, "client")
+	if _, err := s.SetAlias("operator", "client"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.requestHostnames(rec, []string{"myname"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Journal.Sync(s.JournalState); err != nil {
+		t.Fatal(err)
+	}
+	state, err := s.Journal.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state.Aliases["myname"]; ok {
+		t.Errorf("granted hostname was persisted: %v", state.Aliases)
+	}
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Aliases()["myname"]; ok {
+		t.Error("granted hostname outlived shutdown")
+	}
+	state, err = s.Journal.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state.Aliases["myname"]; ok {
+		t.Errorf("granted hostname was persisted on shutdown: %v", state.Aliases)
+	}
+	if state.Aliases["operator"] != "client" {
+		t.Errorf("operator alias was lost: %v", state.Aliases)
+	}
+}
@@ -0,0 +1,171 @@
+package relay
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/webteleport/utils"
+)
+
+// IngressPolicy restricts who may reach a tunnel through the relay
+//
+// It is declared by the client in its edge tags:
+//
+//	?auth=basic:<user>:<pass>   HTTP basic auth
+//	?auth=bearer:<token>        Authorization: Bearer <token>
+//	?auth=signed:<secret>       ?expires=<unix seconds>&sig=<hex hmac-sha256 of "<path>:<expires>">
+//	?allow=<ip or cidr>         client ip allowlist
+//
+// A request must come from an allowed ip (if any are listed)
+// and present at least one accepted credential (if any are listed)
+type IngressPolicy struct {
+	Basic  [][2]string
+	Bearer []string
+	Signed []string
+	Allow  []netip.Prefix
+}
+
+// ParseIngressPolicy parses the auth and allow tags, it returns nil if neither is set
+func ParseIngressPolicy(v url.Values) (*IngressPolicy, error) {
+	if len(v["auth"]) == 0 && len(v["allow"]) == 0 {
+		return nil, nil
+	}
+	p := &IngressPolicy{}
+	for _, auth := range v["auth"] {
+		kind, arg, _ := strings.Cut(auth, ":")
+		if arg == "" {
+			return nil, fmt.Errorf("invalid auth %q", kind)
+		}
+		switch kind {
+		case "basic":
+			user, pass, ok := strings.Cut(arg, ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid auth basic: want basic:<user>:<pass>")
+			}
+			p.Basic = append(p.Basic, [2]string{user, pass})
+		case "bearer":
+			p.Bearer = append(p.Bearer, arg)
+		case "signed":
+			p.Signed = append(p.Signed, arg)
+		default:
+			return nil, fmt.Errorf("unknown auth kind %q", kind)
+		}
+	}
+	for _, allow := range v["allow"] {
+		prefix, err := netip.ParsePrefix(allow)
+		if err != nil {
+			addr, aerr := netip.ParseAddr(allow)
+			if aerr != nil {
+				return nil, fmt.Errorf("invalid allow %q: %w", allow, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		p.Allow = append(p.Allow, prefix.Masked())
+	}
+	return p, nil
+}
+
+// Handler enforces the policy in front of next, a nil policy allows everything
+func (p *IngressPolicy) Handler(next http.Handler) http.Handler {
+	if p == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !p.allowed(r) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if !p.authorized(r) {
+			if len(p.Basic) > 0 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="webteleport"`)
+			}
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (p *IngressPolicy) allowed(r *http.Request) bool {
+	if len(p.Allow) == 0 {
+		return true
+	}
+	addr, err := netip.ParseAddr(clientIP(r))
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range p.Allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *IngressPolicy) authorized(r *http.Request) bool {
+	if len(p.Basic) == 0 && len(p.Bearer) == 0 && len(p.Signed) == 0 {
+		return true
+	}
+	if user, pass, ok := r.BasicAuth(); ok {
+		for _, cred := range p.Basic {
+			if secureEqual(user, cred[0]) && secureEqual(pass, cred[1]) {
+				return true
+			}
+		}
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		for _, t := range p.Bearer {
+			if secureEqual(token, t) {
+				return true
+			}
+		}
+	}
+	for _, secret := range p.Signed {
+		if validSignedURL(r.URL, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// SignURLPath computes the sig query parameter accepted by auth=signed:<secret>
+func SignURLPath(secret, path string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s:%d", path, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func validSignedURL(u *url.URL, secret string) bool {
+	q := u.Query()
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	return secureEqual(q.Get("sig"), SignURLPath(secret, u.Path, expires))
+}
+
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// clientIP returns the address of the visitor
+//
+// Forwarding headers are only trusted when TRUST_PROXY_HEADERS is set,
+// otherwise anyone could spoof their way past an allowlist
+func clientIP(r *http.Request) string {
+	if os.Getenv("TRUST_PROXY_HEADERS") != "" {
+		return utils.RealIP(r)
+	}
+	return utils.StripPort(r.RemoteAddr)
+}
@@ -0,0 +1,99 @@
+package relay
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"sync/atomic"
+
+	"github.com/webteleport/webteleport/tunnel"
+)
+
+const (
+	PoolRoundRobin  = "round-robin"
+	PoolLeastActive = "least-active"
+)
+
+// Pool balances requests across several records registered under the same key
+//
+// Clients opt in with the pool tag, e.g. ?pool=least-active, all members
+// share the strategy of the first one
+type Pool struct {
+	Strategy string
+	lock     sync.RWMutex
+	members  []*Record
+	next     atomic.Uint64
+}
+
+// poolStrategy returns the strategy requested in the pool tag, if any
+func poolStrategy(v url.Values) (strategy string, ok bool, err error) {
+	if !v.Has("pool") {
+		return "", false, nil
+	}
+	switch strategy = v.Get("pool"); strategy {
+	case "", "1", "true", PoolRoundRobin:
+		return PoolRoundRobin, true, nil
+	case PoolLeastActive:
+		return PoolLeastActive, true, nil
+	default:
+		return "", false, fmt.Errorf("unknown pool strategy %q", strategy)
+	}
+}
+
+func NewPool(strategy string, first *Record) *Pool {
+	return &Pool{
+		Strategy: strategy,
+		members:  []*Record{first},
+	}
+}
+
+func (p *Pool) Add(rec *Record) {
+	p.lock.Lock()
+	p.members = append(p.members, rec)
+	p.lock.Unlock()
+}
+
+// Remove drops the member serving tssn, returning it and the number of members left
+func (p *Pool) Remove(tssn tunnel.Session) (removed *Record, left int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for i, rec := range p.members {
+		if rec.Session == tssn {
+			removed = rec
+			p.members = append(p.members[:i:i], p.members[i+1:]...)
+			break
+		}
+	}
+	return removed, len(p.members)
+}
+
+func (p *Pool) Members() []*Record {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return append([]*Record(nil), p.members...)
+}
+
+// Pick chooses the member to serve the next request
+func (p *Pool) Pick() *Record {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	if len(p.members) == 0 {
+		return nil
+	}
+	if p.Strategy == PoolLeastActive {
+		var best *Record
+		var bestActive int64
+		for _, rec := range p.members {
+			var active int64
+			if stats := rec.Stats(); stats != nil {
+				active = stats.ActiveRequests.Load()
+			}
+			if best == nil || active < bestActive {
+				best, bestActive = rec, active
+			}
+		}
+		return best
+	}
+	n := p.next.Add(1) - 1
+	return p.members[n%uint64(len(p.members))]
+}
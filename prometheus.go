@@ -0,0 +1,104 @@
+package relay
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// MetricsHandler exposes relay metrics in the prometheus text format
+func (i *IngressHandler) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	WritePrometheus(bw, i.storage.Records())
+	bw.Flush()
+}
+
+// WritePrometheus writes the global counters and per-record statistics of all
+func WritePrometheus(w *bufio.Writer, all []*Record) {
+	counter := func(name, help string, v int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+	}
+	counter("webteleport_relay_sessions_accepted_total", "Sessions accepted by the relay.", expvars.WebteleportRelaySessionsAccepted.Value())
+	counter("webteleport_relay_sessions_closed_total", "Sessions closed by the relay.", expvars.WebteleportRelaySessionsClosed.Value())
+	counter("webteleport_relay_streams_spawned_total", "Streams opened to tunnels.", expvars.WebteleportRelayStreamsSpawned.Value())
+	counter("webteleport_relay_streams_closed_total", "Streams to tunnels closed.", expvars.WebteleportRelayStreamsClosed.Value())
+	counter("webteleport_relay_quota_exceeded_total", "Registrations refused for exceeding a quota.", expvars.WebteleportRelayQuotaExceeded.Value())
+
+	fmt.Fprintf(w, "# HELP webteleport_relay_tunnels Tunnels currently registered.\n")
+	fmt.Fprintf(w, "# TYPE webteleport_relay_tunnels gauge\n")
+	fmt.Fprintf(w, "webteleport_relay_tunnels %d\n", len(all))
+
+	type family struct {
+		name, kind, help string
+		value            func(TransportStatsSnapshot) int64
+	}
+	families := []family{
+		{"webteleport_relay_tunnel_bytes_sent_total", "counter", "Bytes written into upgraded connections, such as websockets, proxied to the tunnel.", func(s TransportStatsSnapshot) int64 { return s.BytesSent }},
+		{"webteleport_relay_tunnel_bytes_received_total", "counter", "Bytes of request and response bodies proxied through the tunnel, in both directions, plus bytes read from upgraded connections.", func(s TransportStatsSnapshot) int64 { return s.BytesReceived }},
+		{"webteleport_relay_tunnel_requests_total", "counter", "Requests proxied to the tunnel.", func(s TransportStatsSnapshot) int64 { return s.RequestCount }},
+		{"webteleport_relay_tunnel_responses_total", "counter", "Responses received from the tunnel.", func(s TransportStatsSnapshot) int64 { return s.ResponseCount }},
+		{"webteleport_relay_tunnel_failed_requests_total", "counter", "Requests to the tunnel that failed.", func(s TransportStatsSnapshot) int64 { return s.FailedRequests }},
+		{"webteleport_relay_tunnel_active_requests", "gauge", "Requests to the tunnel in flight, until their response body is done or their upgraded connection closed.", func(s TransportStatsSnapshot) int64 { return s.ActiveRequests }},
+	}
+
+	type sample struct {
+		labels string
+		stats  *TransportStats
+		snap   TransportStatsSnapshot
+	}
+	samples := []sample{}
+	for _, rec := range all {
+		stats := rec.Stats()
+		if stats == nil {
+			continue
+		}
+		// pool members and standbys share a key, the id keeps their series apart
+		labels := fmt.Sprintf(`key="%s",id="%s",transport="%s"`, escapeLabel(rec.Key), escapeLabel(rec.ID), escapeLabel(rec.Transport))
+		samples = append(samples, sample{labels, stats, stats.Snapshot()})
+	}
+
+	for _, f := range families {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		for _, s := range samples {
+			fmt.Fprintf(w, "%s{%s} %d\n", f.name, s.labels, f.value(s.snap))
+		}
+	}
+
+	histograms := []struct {
+		name, help string
+		value      func(*TransportStats) *Histogram
+	}{
+		{"webteleport_relay_tunnel_request_duration_seconds", "Duration of requests proxied to the tunnel until the response body is done.", func(s *TransportStats) *Histogram { return s.RequestDurations }},
+		{"webteleport_relay_tunnel_time_to_first_byte_seconds", "Duration of requests proxied to the tunnel until response headers arrive.", func(s *TransportStats) *Histogram { return s.TimeToFirstByte }},
+	}
+	for _, f := range histograms {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", f.name, f.help, f.name)
+		for _, s := range samples {
+			if h := f.value(s.stats); h != nil {
+				writePrometheusHistogram(w, f.name, s.labels, h.Snapshot())
+			}
+		}
+	}
+}
+
+func writePrometheusHistogram(w *bufio.Writer, name, labels string, h HistogramSnapshot) {
+	var cumulative int64
+	for i, bound := range h.Bounds {
+		cumulative += h.Counts[i]
+		le := strconv.FormatFloat(bound.Seconds(), 'g', -1, 64)
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, le, cumulative)
+	}
+	cumulative += h.Counts[len(h.Bounds)]
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, cumulative)
+	fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels, strconv.FormatFloat(h.Sum.Seconds(), 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, cumulative)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
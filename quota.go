@@ -0,0 +1,102 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Quotas caps the number of records, zero values mean unlimited
+//
+// Pool members and standbys count as records of their own
+type Quotas struct {
+	PerIP        int `json:"perIP,omitempty"`
+	PerPrincipal int `json:"perPrincipal,omitempty"`
+	Total        int `json:"total,omitempty"`
+}
+
+// quotaUsage counts the records in the session index by ip and principal,
+// so that quotas are checked without scanning every record
+type quotaUsage struct {
+	total        int
+	perIP        map[string]int
+	perPrincipal map[string]int
+}
+
+// add counts rec delta times
+func (u *quotaUsage) add(rec *Record, delta int) {
+	if u.perIP == nil {
+		u.perIP = map[string]int{}
+		u.perPrincipal = map[string]int{}
+	}
+	u.total += delta
+	addCount(u.perIP, rec.IP, delta)
+	if rec.Principal != "" {
+		addCount(u.perPrincipal, rec.Principal, delta)
+	}
+}
+
+// addCount adds delta to m[k], dropping keys that reach zero
+func addCount(m map[string]int, k string, delta int) {
+	if m[k]+delta == 0 {
+		delete(m, k)
+	} else {
+		m[k] += delta
+	}
+}
+
+// allRecordsLocked lists primaries, pool members and standbys, caller must hold s.Lock
+func (s *Store) allRecordsLocked() []*Record {
+	return allRecords(s.RecordMap, s.StandbyMap)
+}
+
+// checkQuotaLocked reports whether rec fits into s.Quotas, not counting
+// the records of replacing which are about to go away, caller must hold s.Lock
+func (s *Store) checkQuotaLocked(rec, replacing *Record) error {
+	q := s.Quotas
+	if q == (Quotas{}) {
+		return nil
+	}
+	total := s.usage.total
+	perIP := s.usage.perIP[rec.IP]
+	perPrincipal := s.usage.perPrincipal[rec.Principal]
+	if replacing != nil {
+		leaving := []*Record{replacing}
+		if replacing.Pool != nil {
+			leaving = replacing.Pool.Members()
+		}
+		for _, other := range leaving {
+			total--
+			if other.IP == rec.IP {
+				perIP--
+			}
+			if rec.Principal != "" && other.Principal == rec.Principal {
+				perPrincipal--
+			}
+		}
+	}
+	var err error
+	switch {
+	case q.Total > 0 && total >= q.Total:
+		err = fmt.Errorf("%w: %d records in total", ErrQuotaExceeded, q.Total)
+	case q.PerIP > 0 && perIP >= q.PerIP:
+		err = fmt.Errorf("%w: %d records per ip", ErrQuotaExceeded, q.PerIP)
+	case q.PerPrincipal > 0 && rec.Principal != "" && perPrincipal >= q.PerPrincipal:
+		err = fmt.Errorf("%w: %d records per principal", ErrQuotaExceeded, q.PerPrincipal)
+	}
+	if err != nil {
+		expvars.WebteleportRelayQuotaExceeded.Add(1)
+	}
+	return err
+}
+
+// quotasFromEnv reads QUOTA_PER_IP, QUOTA_PER_PRINCIPAL and QUOTA_TOTAL
+func quotasFromEnv() (q Quotas) {
+	q.PerIP, _ = strconv.Atoi(os.Getenv("QUOTA_PER_IP"))
+	q.PerPrincipal, _ = strconv.Atoi(os.Getenv("QUOTA_PER_PRINCIPAL"))
+	q.Total, _ = strconv.Atoi(os.Getenv("QUOTA_TOTAL"))
+	return
+}
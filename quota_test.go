@@ -0,0 +1,57 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestQuotaUsage(t *testing.T) {
+	s := newTestStore()
+	s.Quotas = Quotas{PerIP: 2, Total: 3}
+	a := addTestRecord(s, "a")
+	b := addTestRecord(s, "b")
+	check := func(ip string) error {
+		s.Lock.RLock()
+		defer s.Lock.RUnlock()
+		return s.checkQuotaLocked(&Record{Key: "new", IP: ip}, nil)
+	}
+	if err := check("127.0.0.1"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("third record of one ip: got %v, want %v", err, ErrQuotaExceeded)
+	}
+	if err := check("10.0.0.1"); err != nil {
+		t.Errorf("record of another ip: %v", err)
+	}
+	s.Lock.RLock()
+	err := s.checkQuotaLocked(&Record{Key: "a", IP: "127.0.0.1"}, a)
+	s.Lock.RUnlock()
+	if err != nil {
+		t.Errorf("replacing a record of the same ip: %v", err)
+	}
+
+	s.RemoveSession(a.Session)
+	s.RemoveSession(b.Session)
+	s.RemoveSession(b.Session)
+	if s.usage.total != 0 || len(s.usage.perIP) != 0 {
+		t.Errorf("usage left after removing every record: %+v", s.usage)
+	}
+}
+
+func BenchmarkCheckQuota(b *testing.B) {
+	for _, n := range benchmarkRecordCounts {
+		b.Run(fmt.Sprintf("records=%d", n), func(b *testing.B) {
+			s := newBenchmarkStore(n)
+			s.Quotas = Quotas{PerIP: n + 1, Total: n + 1}
+			rec := &Record{Key: "new", IP: "127.0.0.1"}
+			b.ResetTimer()
+			for range b.N {
+				s.Lock.Lock()
+				err := s.checkQuotaLocked(rec, nil)
+				s.Lock.Unlock()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
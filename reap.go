@@ -0,0 +1,92 @@
+package relay
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// Reap evicts records that served no request for s.IdleTimeout, or have
+// been connected for longer than s.MaxLifetime, and returns how many
+//
+// Records without transport stats, such as tcp ones, and standby records
+// are never considered idle.
+func (s *Store) Reap(now time.Time) (evicted int) {
+	if s.IdleTimeout <= 0 && s.MaxLifetime <= 0 {
+		return 0
+	}
+	type eviction struct {
+		rec    *Record
+		reason string
+	}
+	var due []eviction
+	s.Lock.RLock()
+	for _, rec := range s.allRecordsLocked() {
+		if s.MaxLifetime > 0 && now.Sub(rec.Since) > s.MaxLifetime {
+			due = append(due, eviction{rec, ReasonLifetime})
+			continue
+		}
+		if s.IdleTimeout > 0 && !rec.Standby && now.Sub(idleSince(rec)) > s.IdleTimeout {
+			due = append(due, eviction{rec, ReasonIdle})
+		}
+	}
+	s.Lock.RUnlock()
+	for _, e := range due {
+		s.Logger.Info("evict", "key", e.rec.Key, "ip", e.rec.IP, "reason", e.reason)
+		s.evict(e.rec, e.reason)
+	}
+	return len(due)
+}
+
+// idleSince is when rec last finished serving, or a far future time if it
+// is serving right now or can not tell
+func idleSince(rec *Record) time.Time {
+	stats := rec.Stats()
+	if stats == nil || stats.ActiveRequests.Load() > 0 {
+		return time.Now().Add(time.Hour)
+	}
+	if last := stats.LastRequestTime.Load(); last != 0 {
+		return time.Unix(0, last)
+	}
+	return rec.Since
+}
+
+// evict tells the client of rec why it is being removed, then closes its session
+func (s *Store) evict(rec *Record, reason string) {
+	_ = rec.Control.Send(ControlMessage{Type: "close", Reason: reason})
+	s.unroute(rec.Session, reason)
+	_ = rec.Session.Close()
+}
+
+// reapLoop runs Reap until ctx is done, and forgets expired persisted
+// records along the way
+func (s *Store) reapLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.reapInterval()):
+		}
+		s.Reap(time.Now())
+		s.Lock.Lock()
+		s.prunePersistedLocked(time.Now())
+		s.Lock.Unlock()
+	}
+}
+
+// reapInterval is a fraction of the shortest timeout, between a second and a minute
+func (s *Store) reapInterval() time.Duration {
+	d := time.Minute
+	for _, t := range []time.Duration{s.IdleTimeout, s.MaxLifetime} {
+		if t > 0 {
+			d = min(d, t/4)
+		}
+	}
+	return max(d, time.Second)
+}
+
+// durationFromEnv parses a duration like 90s or 1h, zero if unset or invalid
+func durationFromEnv(key string) time.Duration {
+	d, _ := time.ParseDuration(os.Getenv(key))
+	return max(d, 0)
+}
@@ -1,9 +1,16 @@
 package relay
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net"
 	"net/http"
 	"net/url"
+	"path"
+	"reflect"
 	"slices"
+	"sync"
 	"time"
 
 	"github.com/btwiuse/tags"
@@ -12,19 +19,93 @@ import (
 
 type Record struct {
 	Key          string            `json:"key"`
+	ID           string            `json:"id"` // tells apart pool members and standbys sharing a key
 	Session      tunnel.Session    `json:"-"`
+	Control      *Control          `json:"-"`
 	RoundTripper http.RoundTripper `json:"metrics"`
 	Header       tags.Tags         `json:"header"`
 	Tags         tags.Tags         `json:"tags"`
 	Since        time.Time         `json:"since"`
 	IP           string            `json:"ip"`
 	Path         string            `json:"path"`
+	Listener     net.Listener      `json:"-"`
+	PublicKey    string            `json:"publicKey,omitempty"`
+	Principal    string            `json:"principal,omitempty"`
+	Policy       *IngressPolicy    `json:"-"`
+	Transport    string            `json:"transport"`
+	// shared by all records balanced under the same key, nil if not pooled
+	Pool *Pool `json:"-"`
+	// waiting to take over the key when the primary goes away
+	Standby bool `json:"standby,omitempty"`
+	// aliases requested over the control stream, released with the record
+	Hostnames []string `json:"hostnames,omitempty"`
+	// round trip times of pings, nil if the client does not answer them
+	Heartbeat *Heartbeat `json:"heartbeat,omitempty"`
+	// why the record was removed, empty while it is live
+	Reason string `json:"reason,omitempty"`
+	// effective limits of this record, see Store.Limits
+	Limits   Limits   `json:"limits"`
+	Limiters Limiters `json:"-"`
+	// guards Tags, Standby, Hostnames and Reason, they are written holding
+	// both mu and Store.Lock, so either is enough to read them
+	mu sync.RWMutex
+}
+
+// MarshalJSON implements the json.Marshaler interface
+func (r *Record) MarshalJSON() ([]byte, error) {
+	type record Record
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return json.Marshal((*record)(r))
+}
+
+// currentTags returns the tags of r, they are swapped rather than modified
+func (r *Record) currentTags() tags.Tags {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.Tags
+}
+
+// isStandby reports whether r waits to take over its key
+func (r *Record) isStandby() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.Standby
+}
+
+// newRecordID returns a random id for a Record
+func newRecordID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Stats returns the transport statistics of the record, if it has any
+func (r *Record) Stats() *TransportStats {
+	mt, ok := r.RoundTripper.(*MetricsTransport)
+	if !ok {
+		return nil
+	}
+	return mt.Stats
+}
+
+// sessionTransport names the transport of tssn after its package, e.g. websocket or quic-go
+func sessionTransport(tssn tunnel.Session) string {
+	t := reflect.TypeOf(tssn)
+	if t == nil {
+		return ""
+	}
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return path.Base(t.PkgPath())
 }
 
 func (r *Record) Matches(kvs url.Values) (ok bool) {
+	values := r.currentTags().Values
 	for k, v := range kvs {
 		// r.Tags contains k
-		tv, has := r.Tags.Values[k]
+		tv, has := values[k]
 		if !has {
 			return false
 		}
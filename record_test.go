@@ -0,0 +1,73 @@
+package relay
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+// run with -race, mutable record fields are written while lock-free readers
+// match, marshal and publish the record
+func TestRecordConcurrentUpdates(t *testing.T) {
+	s := newTestStore()
+	s.MaxHostnames = 0
+	s.Takeover = TakeoverStandby
+	rec := addTestRecord(s, "client")
+	standby := &Record{Key: "client", ID: newRecordID(), Session: newFakeSession()}
+	if _, err := s.SetAlias("red", "?color=red"); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	for range 4 {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				s.LookupRecord("red")
+				if _, err := json.Marshal(s.Records()); err != nil {
+					t.Error(err)
+				}
+				recordEvent(EventRecordUpdated, rec)
+				rec.isStandby()
+			}
+		}()
+	}
+
+	for i := range 200 {
+		if _, err := s.UpdateTags(rec, url.Values{"color": {"red", fmt.Sprint(i)}}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.requestHostnames(rec, []string{fmt.Sprintf("h%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+		s.Mut(func(store *Store) {
+			if _, err := store.takeoverLocked(rec, standby); err != nil {
+				t.Error(err)
+			}
+			store.indexLocked(standby)
+		})
+		s.closed(ReasonClosed, standby)
+		s.Mut(func(store *Store) {
+			store.removeRecordLocked(standby)
+			store.unindexLocked(standby)
+		})
+	}
+	close(stop)
+	readers.Wait()
+
+	if got, ok := s.LookupRecord("red"); !ok || got != rec {
+		t.Errorf("selector lookup: got %v, want the updated record", got)
+	}
+	if got := rec.currentTags().Get("color"); got != "red" {
+		t.Errorf("tags not updated: color=%s", got)
+	}
+}
@@ -0,0 +1,281 @@
+package relay
+
+import (
+	"hash/maphash"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/exp/maps"
+)
+
+// routeFanout is the fanout of both levels of shards of a Routes snapshot,
+// a change to one key copies two arrays of routeFanout pointers and one
+// shard holding about 1/routeFanout² of the routing state
+const routeFanout = 64
+
+var routeSeed = maphash.MakeSeed()
+
+// routeShard returns the group of key k and its shard within the group
+func routeShard(k string) (group, shard int) {
+	h := maphash.String(routeSeed, k)
+	return int(h % routeFanout), int(h / routeFanout % routeFanout)
+}
+
+// Routes is an immutable snapshot of the routing state of a Store
+//
+// Mut and update publish a fresh snapshot before releasing s.Lock, so
+// proxied requests resolve hosts without ever contending with registrations.
+// A published Routes must not be modified, and the routing maps of a
+// Store must only be changed inside Mut or update.
+//
+// The snapshot is sharded by key, so that update only copies the shards
+// of the keys it touched, the others are shared with the previous snapshot.
+type Routes struct {
+	groups [routeFanout]*routesGroup
+	// wildcard aliases and their targets, patterns longest first
+	wildcards       []string
+	wildcardTargets map[string]string
+	logger          *slog.Logger
+	// results of selectRecord by selector, nil when nothing matched,
+	// dropped with the snapshot when the records or their tags change
+	selected  sync.Map
+	nselected atomic.Int64
+}
+
+// routesGroup is the second level of shards, nil shards are empty
+type routesGroup [routeFanout]*routesShard
+
+// routesShard holds the keys of one shard, exact aliases included
+type routesShard struct {
+	records  map[string]*Record
+	aliases  map[string]string
+	standbys map[string][]*Record
+}
+
+// shard returns the shard of key k, nil if it is empty
+func (rt *Routes) shard(k string) *routesShard {
+	g, i := routeShard(k)
+	if rt.groups[g] == nil {
+		return nil
+	}
+	return rt.groups[g][i]
+}
+
+// eachShard calls f for every non-empty shard
+func (rt *Routes) eachShard(f func(*routesShard)) {
+	for _, group := range rt.groups {
+		if group == nil {
+			continue
+		}
+		for _, shard := range group {
+			if shard != nil {
+				f(shard)
+			}
+		}
+	}
+}
+
+// routesWriter fills in a Routes under construction, copying the groups
+// and shards it shares with the previous snapshot on first write
+type routesWriter struct {
+	rt     *Routes
+	groups [routeFanout]bool
+	shards map[*routesShard]bool
+}
+
+func newRoutesWriter(rt *Routes) *routesWriter {
+	return &routesWriter{rt: rt, shards: map[*routesShard]bool{}}
+}
+
+// shard returns the shard of key k, owned by the snapshot being written
+func (w *routesWriter) shard(k string) *routesShard {
+	g, i := routeShard(k)
+	if !w.groups[g] {
+		group := &routesGroup{}
+		if old := w.rt.groups[g]; old != nil {
+			*group = *old
+		}
+		w.rt.groups[g] = group
+		w.groups[g] = true
+	}
+	shard := w.rt.groups[g][i]
+	if w.shards[shard] {
+		return shard
+	}
+	owned := &routesShard{
+		records:  map[string]*Record{},
+		aliases:  map[string]string{},
+		standbys: map[string][]*Record{},
+	}
+	if shard != nil {
+		owned.records = maps.Clone(shard.records)
+		owned.aliases = maps.Clone(shard.aliases)
+		owned.standbys = maps.Clone(shard.standbys)
+	}
+	w.rt.groups[g][i] = owned
+	w.shards[owned] = true
+	return owned
+}
+
+// routesLocked copies the routing state of s, caller must hold s.Lock
+func (s *Store) routesLocked() *Routes {
+	rt := &Routes{
+		wildcardTargets: map[string]string{},
+		logger:          s.Logger,
+	}
+	w := newRoutesWriter(rt)
+	for k, rec := range s.RecordMap {
+		w.shard(k).records[k] = rec
+	}
+	for k, recs := range s.StandbyMap {
+		w.shard(k).standbys[k] = recs
+	}
+	for k, v := range s.AliasMap {
+		if strings.Contains(k, "*") {
+			rt.wildcardTargets[k] = v
+			continue
+		}
+		w.shard(k).aliases[k] = v
+	}
+	rt.sortWildcards()
+	return rt
+}
+
+// touchLocked marks keys whose record, standbys or alias changed, so that
+// update republishes them, caller must hold s.Lock
+func (s *Store) touchLocked(keys ...string) {
+	if s.touched == nil {
+		s.touched = map[string]struct{}{}
+	}
+	for _, k := range keys {
+		s.touched[k] = struct{}{}
+	}
+}
+
+// patchRoutesLocked derives a snapshot from prev, copying only the shards
+// of the touched keys, caller must hold s.Lock
+func (s *Store) patchRoutesLocked(prev *Routes) *Routes {
+	rt := &Routes{
+		groups:          prev.groups,
+		wildcards:       prev.wildcards,
+		wildcardTargets: prev.wildcardTargets,
+		logger:          s.Logger,
+	}
+	w := newRoutesWriter(rt)
+	wildcards := false
+	for k := range s.touched {
+		if strings.Contains(k, "*") {
+			if !wildcards {
+				rt.wildcardTargets = maps.Clone(prev.wildcardTargets)
+				wildcards = true
+			}
+			if v, ok := s.AliasMap[k]; ok {
+				rt.wildcardTargets[k] = v
+			} else {
+				delete(rt.wildcardTargets, k)
+			}
+			continue
+		}
+		shard := w.shard(k)
+		if rec, ok := s.RecordMap[k]; ok {
+			shard.records[k] = rec
+		} else {
+			delete(shard.records, k)
+		}
+		if recs, ok := s.StandbyMap[k]; ok {
+			shard.standbys[k] = recs
+		} else {
+			delete(shard.standbys, k)
+		}
+		if v, ok := s.AliasMap[k]; ok {
+			shard.aliases[k] = v
+		} else {
+			delete(shard.aliases, k)
+		}
+	}
+	if wildcards {
+		rt.sortWildcards()
+	}
+	clear(s.touched)
+	return rt
+}
+
+func (rt *Routes) sortWildcards() {
+	rt.wildcards = maps.Keys(rt.wildcardTargets)
+	sort.Slice(rt.wildcards, func(i, j int) bool {
+		if len(rt.wildcards[i]) != len(rt.wildcards[j]) {
+			return len(rt.wildcards[i]) > len(rt.wildcards[j])
+		}
+		return rt.wildcards[i] < rt.wildcards[j]
+	})
+}
+
+// Routes returns the current routing snapshot without taking s.Lock
+func (s *Store) Routes() *Routes {
+	if rt := s.routes.Load(); rt != nil {
+		return rt
+	}
+	// nothing was published yet, the maps may have been set up by hand
+	s.Lock.RLock()
+	rt := s.routesLocked()
+	s.Lock.RUnlock()
+	s.routes.CompareAndSwap(nil, rt)
+	return s.routes.Load()
+}
+
+// Record returns the primary record of key k, aliases are not resolved
+func (rt *Routes) Record(k string) (*Record, bool) {
+	shard := rt.shard(k)
+	if shard == nil {
+		return nil, false
+	}
+	rec, ok := shard.records[k]
+	return rec, ok
+}
+
+// alias returns the target of the exact or wildcard alias k
+func (rt *Routes) alias(k string) (string, bool) {
+	if shard := rt.shard(k); shard != nil {
+		if v, ok := shard.aliases[k]; ok {
+			return v, true
+		}
+	}
+	v, ok := rt.wildcardTargets[k]
+	return v, ok
+}
+
+// Aliases returns a copy of every alias
+func (rt *Routes) Aliases() map[string]string {
+	all := maps.Clone(rt.wildcardTargets)
+	rt.eachShard(func(shard *routesShard) {
+		for k, v := range shard.aliases {
+			all[k] = v
+		}
+	})
+	return all
+}
+
+// All lists primaries, pool members and standbys
+func (rt *Routes) All() (all []*Record) {
+	rt.eachShard(func(shard *routesShard) {
+		all = append(all, allRecords(shard.records, shard.standbys)...)
+	})
+	return
+}
+
+func allRecords(records map[string]*Record, standbys map[string][]*Record) (all []*Record) {
+	for _, rec := range records {
+		if rec.Pool != nil {
+			all = append(all, rec.Pool.Members()...)
+			continue
+		}
+		all = append(all, rec)
+	}
+	for _, recs := range standbys {
+		all = append(all, recs...)
+	}
+	return
+}
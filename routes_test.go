@@ -0,0 +1,255 @@
+package relay
+
+import (
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// the patched snapshot must always equal one built from scratch
+func TestRoutesPatch(t *testing.T) {
+	s := newTestStore()
+	s.Takeover = TakeoverStandby
+	recs := map[string]*Record{}
+	for i := range 2000 {
+		k := fmt.Sprintf("k%d", rand.IntN(200))
+		switch rand.IntN(4) {
+		case 0:
+			if rec, ok := recs[k]; ok {
+				s.removeSession(rec.Session, ReasonClosed)
+				delete(recs, k)
+				continue
+			}
+			recs[k] = addTestRecord(s, k)
+		case 1:
+			s.Alias("a-"+k, k)
+		case 2:
+			s.Unalias("a-" + k)
+		case 3:
+			s.Alias(fmt.Sprintf("*-%d", i%7), k)
+		}
+		if i%100 != 0 {
+			continue
+		}
+		got := s.Routes()
+		s.Lock.RLock()
+		want := s.routesLocked()
+		records := maps.Clone(s.RecordMap)
+		aliases := maps.Clone(s.AliasMap)
+		s.Lock.RUnlock()
+		n := 0
+		got.eachShard(func(shard *routesShard) {
+			n += len(shard.records)
+		})
+		if n != len(records) {
+			t.Fatalf("step %d: %d records, want %d", i, n, len(records))
+		}
+		for k, rec := range records {
+			if r, ok := got.Record(k); !ok || r != rec {
+				t.Fatalf("step %d: record %s missing", i, k)
+			}
+		}
+		if !maps.Equal(got.Aliases(), aliases) {
+			t.Fatalf("step %d: aliases %v, want %v", i, got.Aliases(), aliases)
+		}
+		if fmt.Sprint(got.wildcards) != fmt.Sprint(want.wildcards) {
+			t.Fatalf("step %d: wildcards %v, want %v", i, got.wildcards, want.wildcards)
+		}
+	}
+}
+
+// selector results are cached per snapshot, tag updates must republish
+func TestRoutesSelectorCache(t *testing.T) {
+	s := newTestStore()
+	a := addTestRecord(s, "a")
+	b := addTestRecord(s, "b")
+	if _, err := s.SetAlias("red", "?color=red"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.UpdateTags(a, url.Values{"color": {"red"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := s.LookupRecord("red"); !ok || got != a {
+		t.Fatalf("got %v, want a", got)
+	}
+	if _, err := s.UpdateTags(a, url.Values{"color": nil}); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := s.LookupRecord("red"); ok {
+		t.Fatalf("got %v, want no match", got)
+	}
+	if _, err := s.UpdateTags(b, url.Values{"color": {"red"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := s.LookupRecord("red"); !ok || got != b {
+		t.Fatalf("got %v, want b", got)
+	}
+}
+
+// churnInterval paces churn, so that both read paths face the same rate
+// of changes even when they share a single cpu with it
+const churnInterval = 100 * time.Microsecond
+
+// churn sets and deletes keys until stop is closed, returning the number
+// of changes made
+func churn(stop <-chan struct{}, set func(k string), del func(k string)) <-chan int64 {
+	done := make(chan int64, 1)
+	go func() {
+		var n int64
+		for {
+			select {
+			case <-stop:
+				done <- n
+				return
+			case <-time.After(churnInterval):
+			}
+			k := fmt.Sprintf("churn%d", n%64)
+			if n%128 < 64 {
+				set(k)
+			} else {
+				del(k)
+			}
+			n++
+		}
+	}()
+	return done
+}
+
+// BenchmarkLookupUnderChurn compares proxied lookups through the routing
+// snapshot against the global RWMutex they used to take, while keys are
+// set and deleted concurrently, each change republishing the snapshot
+func BenchmarkLookupUnderChurn(b *testing.B) {
+	for _, n := range []int{100, 1000, 10000} {
+		b.Run(fmt.Sprintf("snapshot/records=%d", n), func(b *testing.B) {
+			s := newTestStore()
+			for i := range n {
+				addTestRecord(s, fmt.Sprintf("k%d", i))
+			}
+			stop := make(chan struct{})
+			done := churn(stop, func(k string) {
+				s.update(func(store *Store) {
+					store.RecordMap[k] = &Record{Key: k}
+					store.touchLocked(k)
+				})
+			}, func(k string) {
+				s.update(func(store *Store) {
+					delete(store.RecordMap, k)
+					store.touchLocked(k)
+				})
+			})
+			benchmarkLookups(b, n, func(k string) bool {
+				_, ok := s.LookupRecord(k)
+				return ok
+			})
+			close(stop)
+			b.ReportMetric(float64(<-done)/b.Elapsed().Seconds(), "changes/s")
+		})
+		b.Run(fmt.Sprintf("rwmutex/records=%d", n), func(b *testing.B) {
+			s := newTestStore()
+			for i := range n {
+				addTestRecord(s, fmt.Sprintf("k%d", i))
+			}
+			stop := make(chan struct{})
+			done := churn(stop, func(k string) {
+				s.Lock.Lock()
+				s.RecordMap[k] = &Record{Key: k}
+				s.Lock.Unlock()
+			}, func(k string) {
+				s.Lock.Lock()
+				delete(s.RecordMap, k)
+				s.Lock.Unlock()
+			})
+			// LookupRecord as it was before the snapshot, minus aliases
+			benchmarkLookups(b, n, func(k string) bool {
+				s.Lock.RLock()
+				rec, ok := s.RecordMap[k]
+				s.Lock.RUnlock()
+				if ok && rec.Pool != nil {
+					rec = rec.Pool.Pick()
+					ok = rec != nil
+				}
+				return ok
+			})
+			close(stop)
+			b.ReportMetric(float64(<-done)/b.Elapsed().Seconds(), "changes/s")
+		})
+	}
+}
+
+// BenchmarkRepublish compares the cost of a change republishing only the
+// shard of its key against republishing the whole snapshot
+func BenchmarkRepublish(b *testing.B) {
+	for _, n := range []int{100, 1000, 10000} {
+		for _, mode := range []string{"update", "mut"} {
+			b.Run(fmt.Sprintf("%s/records=%d", mode, n), func(b *testing.B) {
+				s := newTestStore()
+				for i := range n {
+					addTestRecord(s, fmt.Sprintf("k%d", i))
+				}
+				publish := s.update
+				if mode == "mut" {
+					publish = s.Mut
+				}
+				rec := &Record{Key: "churn"}
+				b.ResetTimer()
+				for i := range b.N {
+					publish(func(store *Store) {
+						if i%2 == 0 {
+							store.RecordMap[rec.Key] = rec
+						} else {
+							delete(store.RecordMap, rec.Key)
+						}
+						store.touchLocked(rec.Key)
+					})
+				}
+			})
+		}
+	}
+}
+
+// benchmarkLookups looks up the n preloaded keys from every P
+func benchmarkLookups(b *testing.B, n int, lookup func(k string) bool) {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("k%d", i)
+	}
+	var misses atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := rand.IntN(n)
+		for pb.Next() {
+			if !lookup(keys[i%n]) {
+				misses.Add(1)
+			}
+			i++
+		}
+	})
+	if misses.Load() > 0 {
+		b.Fatalf("%d lookups missed", misses.Load())
+	}
+}
+
+func BenchmarkLookupSelector(b *testing.B) {
+	for _, n := range benchmarkRecordCounts {
+		b.Run(fmt.Sprintf("records=%d", n), func(b *testing.B) {
+			s := newBenchmarkStore(n)
+			rec, _ := s.LookupRecord("k0")
+			if _, err := s.UpdateTags(rec, url.Values{"color": {"red"}}); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := s.SetAlias("red-*", "?color=red"); err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for range b.N {
+				if _, ok := s.LookupRecord("red-x"); !ok {
+					b.Fatal("selector did not match")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+var ErrShuttingDown = errors.New("relay is shutting down")
+
+// Shutdown gracefully stops the relay: it stops accepting edges, tells every
+// client to drain, waits for active requests to finish until ctx is done,
+// then closes all sessions. It returns ctx.Err() if requests were cut short.
+//
+// The reaper, journal and webhook goroutines of s are stopped as well.
+func (s *Store) Shutdown(ctx context.Context) error {
+	s.closing.Store(true)
+
+	s.Lock.Lock()
+	upgraders := s.upgraders
+	s.upgraders = nil
+	all := s.allRecordsLocked()
+	s.Lock.Unlock()
+	// no goroutine is started in the background past this point
+	s.cancel()
+	for _, u := range upgraders {
+		_ = u.Close()
+	}
+
+	for _, rec := range all {
+		_ = rec.Control.Send(ControlMessage{Type: "drain", Reason: "shutdown"})
+	}
+	var removed []*Record
+	var released []string
+	s.update(func(store *Store) {
+		for _, rec := range all {
+			r, _ := store.removeLocked(rec.Session)
+			removed = append(removed, r...)
+		}
+		for _, rec := range all {
+			released = append(released, store.releaseHostnamesLocked(rec.Key)...)
+		}
+	})
+	s.closed(ReasonShutdown, removed...)
+	for _, rec := range removed {
+		s.Events.Publish(removedEvent(rec, ReasonShutdown))
+	}
+	for _, name := range released {
+		s.Events.Publish(aliasEvent(EventAliasRemoved, name, ""))
+	}
+	s.Logger.Info("draining", "records", len(all))
+
+	err := waitIdle(ctx, all...)
+	for _, rec := range all {
+		_ = rec.Control.Send(ControlMessage{Type: "drained", Reason: "shutdown"})
+		if rec.Listener != nil {
+			rec.Listener.Close()
+		}
+		_ = rec.Session.Close()
+	}
+	s.workers.Wait()
+	if s.Journal != nil {
+		if err := s.Journal.Sync(s.JournalState); err != nil {
+			s.Logger.Warn("save journal failed", "path", s.Journal.Path, "error", err)
+		}
+	}
+	return err
+}
+
+// background runs f in a goroutine until Shutdown cancels its ctx,
+// Shutdown waits for f to return
+func (s *Store) background(f func(ctx context.Context)) {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	if s.closing.Load() {
+		return
+	}
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		f(s.ctx)
+	}()
+}
+
+// trackUpgrader remembers upgraders that can be closed on Shutdown, such as
+// the tcp and quic listeners, it reports false if the store is shutting down
+func (s *Store) trackUpgrader(u any) bool {
+	s.Lock.Lock()
+	defer s.Lock.Unlock()
+	if s.closing.Load() {
+		return false
+	}
+	if c, ok := u.(io.Closer); ok {
+		s.upgraders = append(s.upgraders, c)
+	}
+	return true
+}
+
+// waitIdle polls until none of recs has active requests, or ctx is done
+func waitIdle(ctx context.Context, recs ...*Record) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		idle := true
+		for _, rec := range recs {
+			if stats := rec.Stats(); stats != nil && stats.ActiveRequests.Load() > 0 {
+				idle = false
+				break
+			}
+		}
+		if idle {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
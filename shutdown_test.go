@@ -0,0 +1,37 @@
+package relay
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Shutdown stops the reaper and journal goroutines and waits for them
+func TestShutdownStopsBackground(t *testing.T) {
+	s, err := NewPersistentStore(filepath.Join(t.TempDir(), "journal.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.reaper.Do(func() { s.background(s.reapLoop) })
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Shutdown(context.Background())
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown is still waiting for background goroutines")
+	}
+
+	started := false
+	s.background(func(context.Context) { started = true })
+	s.workers.Wait()
+	if started {
+		t.Error("a background goroutine was started after Shutdown")
+	}
+}
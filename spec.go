@@ -1,6 +1,7 @@
 package relay
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/btwiuse/dispatcher"
@@ -29,6 +30,9 @@ type Ingress interface {
 	// apply middleware to dispatcher
 	Use(middlewares ...muxr.Middleware)
 
+	// get record by host
+	GetRecord(h string) (*Record, bool)
+
 	// get Session wrapped by http.Transport
 	GetRoundTripper(h string) (http.RoundTripper, bool)
 
@@ -38,8 +42,23 @@ type Ingress interface {
 	// record Info
 	RecordsHandler(w http.ResponseWriter, r *http.Request)
 
+	// prometheus metrics
+	MetricsHandler(w http.ResponseWriter, r *http.Request)
+
+	// server-sent events of storage changes
+	EventsHandler(w http.ResponseWriter, r *http.Request)
+
+	// recently closed records
+	HistoryHandler(w http.ResponseWriter, r *http.Request)
+
 	// subscribe to incoming stream of edge.Edge
 	edge.Subscriber
+
+	// subscribe until ctx is done
+	SubscribeContext(ctx context.Context, upgrader edge.Upgrader) error
+
+	// drain clients and stop accepting edges
+	Shutdown(ctx context.Context) error
 }
 
 // edge.Edge multiplexer
@@ -51,7 +70,7 @@ type Storage interface {
 	RemoveSession(tssn tunnel.Session)
 
 	// upsert session
-	Upsert(k string, r *edge.Edge)
+	Upsert(k string, r *edge.Edge) error
 
 	// get record
 	GetRecord(h string) (*Record, bool)
@@ -68,15 +87,33 @@ type Storage interface {
 	// subscribe to incoming stream of edge.Edge
 	edge.Subscriber
 
+	// subscribe until ctx is done
+	SubscribeContext(ctx context.Context, upgrader edge.Upgrader) error
+
 	// alias
 	Alias(k string, v string)
 
 	// unalias
 	Unalias(k string)
 
+	// validated alias, reports whether it was created
+	SetAlias(k string, v string) (created bool, err error)
+
+	// validated unalias
+	RemoveAlias(k string) error
+
 	// get all aliases
 	Aliases() (all map[string]string)
 
 	// lookup record
 	LookupRecord(k string) (rec *Record, ok bool)
+
+	// subscribe to changes
+	Watch() (<-chan Event, func())
+
+	// recently closed records
+	ClosedRecords() []ClosedRecord
+
+	// drain clients and stop accepting edges
+	Shutdown(ctx context.Context) error
 }
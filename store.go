@@ -1,20 +1,23 @@
 package relay
 
 import (
-	"bufio"
+	"context"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/btwiuse/tags"
-	"github.com/phayes/freeport"
 	"github.com/webteleport/utils"
 	"github.com/webteleport/webteleport/edge"
 	"github.com/webteleport/webteleport/tunnel"
@@ -23,16 +26,131 @@ import (
 
 var _ Storage = (*Store)(nil)
 
-var DefaultStorage = NewStore()
+var DefaultStorage = newDefaultStorage()
+
+// newDefaultStorage configures a Store from the environment:
+//
+//	STORE_PATH          journal file to persist aliases and records
+//	PERSIST_TTL         how long persisted records are kept, 168h by default
+//	AUTH_TOKENS_FILE    api keys file, see LoadTokenFile
+//	AUTH_HMAC_SECRET    secret of HMACAuthenticator
+//	WEBHOOKS            comma separated webhook endpoints
+//	WEBHOOK_SECRET      secret to sign webhook payloads
+//	TAKEOVER            reject, replace (default) or standby
+//	LIMIT_RPS, LIMIT_CONCURRENCY, LIMIT_BPS           per record limits
+//	IP_LIMIT_RPS, IP_LIMIT_CONCURRENCY, IP_LIMIT_BPS  per client ip limits
+//	QUOTA_PER_IP, QUOTA_PER_PRINCIPAL, QUOTA_TOTAL    caps on the number of records
+//	IDLE_TIMEOUT, MAX_LIFETIME                        durations like 30m, see Reap
+//	MAX_HOSTNAMES       hostnames one record may request, 8 by default
+//	HISTORY_SIZE        number of closed records to remember, 256 by default
+func newDefaultStorage() *Store {
+	s := NewStore()
+	if path := os.Getenv("STORE_PATH"); path != "" {
+		ps, err := NewPersistentStore(path)
+		if err != nil {
+			DefaultLogger.Warn("load journal failed, falling back to memory store", "path", path, "error", err)
+		} else {
+			s = ps
+		}
+	}
+	if ttl := durationFromEnv("PERSIST_TTL"); ttl > 0 {
+		s.PersistTTL = ttl
+	}
+	if n, err := strconv.Atoi(os.Getenv("MAX_HOSTNAMES")); err == nil {
+		s.MaxHostnames = n
+	}
+	s.IdleTimeout = durationFromEnv("IDLE_TIMEOUT")
+	s.MaxLifetime = durationFromEnv("MAX_LIFETIME")
+	s.Limits = limitsFromEnv("LIMIT_")
+	s.IPLimits = limitsFromEnv("IP_LIMIT_")
+	s.Quotas = quotasFromEnv()
+	s.History = NewHistory(historySizeFromEnv())
+	if takeover := os.Getenv("TAKEOVER"); takeover != "" {
+		s.Takeover = takeover
+	}
+	auth, err := authenticatorFromEnv()
+	if err != nil {
+		// refuse every edge rather than silently running unauthenticated
+		DefaultLogger.Error("load authenticator failed", "error", err)
+		auth = AuthenticatorFunc(func(*edge.Edge) (string, error) {
+			return "", ErrUnauthorized
+		})
+	}
+	s.Authenticator = auth
+	if wh := webhooksFromEnv(); wh != nil {
+		s.background(func(ctx context.Context) {
+			wh.Watch(ctx, s)
+		})
+	}
+	return s
+}
 
 type Store struct {
 	OnUpdateFunc func(*Store)
 	Logger       *slog.Logger
 	Lock         *sync.RWMutex
+	// heartbeat period, zero disables pings
 	PingInterval time.Duration
-	Client       *http.Client
-	RecordMap    map[string]*Record
-	AliasMap     map[string]string
+	// how long a client has to answer a PING
+	PingTimeout time.Duration
+	// consecutive unanswered pings before a record is evicted, zero never evicts
+	PingMisses int
+	// how long a client has to answer a CHALLENGE
+	ChallengeTimeout time.Duration
+	// cap on the hostnames one record may request, zero means unlimited
+	MaxHostnames int
+	// consulted before allocating, nil accepts everyone
+	Authenticator Authenticator
+	Client        *http.Client
+	RecordMap     map[string]*Record
+	AliasMap      map[string]string
+	// tcp listeners bound by Allocate, waiting to be claimed by Upsert
+	Listeners map[string]net.Listener
+	// record metadata reloaded from a Journal, reclaimed on reconnect
+	Persisted map[string]*JournalRecord
+	// how long persisted records are kept for their clients to come back
+	PersistTTL time.Duration
+	// set by NewPersistentStore
+	Journal *Journal
+	// typed change notifications, see Watch
+	Events *EventBus
+	// what to do when a live key is registered again, see TakeoverReplace
+	Takeover string
+	// standby records waiting to be promoted, by key
+	StandbyMap map[string][]*Record
+	// every record, primary, pooled or standby, by session and key
+	Sessions map[tunnel.Session]map[string]*Record
+	// ceiling for every record, clients may lower it with tags
+	Limits Limits
+	// ceiling shared by all records of the same client ip
+	IPLimits   Limits
+	IPLimiters map[string]*Limiter
+	// caps on the number of records
+	Quotas Quotas
+	// records counted against Quotas, kept by indexLocked and unindexLocked
+	usage quotaUsage
+	// how long a draining record may finish its active requests
+	DrainTimeout time.Duration
+	// evict records serving no requests for this long, zero disables
+	IdleTimeout time.Duration
+	// evict records connected for this long, zero disables
+	MaxLifetime time.Duration
+	// recently closed records
+	History *History
+	// routing snapshot published by Mut, see Routes
+	routes atomic.Pointer[Routes]
+	// hostnames granted over control streams by key, they are not persisted
+	grants map[string][]string
+	// keys changed since the last snapshot, see touchLocked
+	touched map[string]struct{}
+	// set by Shutdown, refuses new edges
+	closing   atomic.Bool
+	upgraders []io.Closer
+	reaper    sync.Once
+	// background goroutines, stopped and waited for by Shutdown
+	ctx     context.Context
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
 }
 
 func getLogLevel() slog.Level {
@@ -56,19 +174,56 @@ var DefaultLogger *slog.Logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.H
 }))
 
 func NewStore() *Store {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Store{
-		Logger:       DefaultLogger,
-		Lock:         &sync.RWMutex{},
-		PingInterval: time.Second * 5,
-		Client:       &http.Client{},
-		RecordMap:    map[string]*Record{},
-		AliasMap:     map[string]string{},
+		ctx:              ctx,
+		cancel:           cancel,
+		Logger:           DefaultLogger,
+		Lock:             &sync.RWMutex{},
+		PingInterval:     time.Second * 5,
+		PingTimeout:      time.Second * 10,
+		PingMisses:       3,
+		ChallengeTimeout: time.Second * 10,
+		DrainTimeout:     time.Second * 30,
+		Client:           &http.Client{},
+		RecordMap:        map[string]*Record{},
+		AliasMap:         map[string]string{},
+		Listeners:        map[string]net.Listener{},
+		Persisted:        map[string]*JournalRecord{},
+		PersistTTL:       7 * 24 * time.Hour,
+		MaxHostnames:     8,
+		Events:           NewEventBus(),
+		Takeover:         TakeoverReplace,
+		StandbyMap:       map[string][]*Record{},
+		Sessions:         map[tunnel.Session]map[string]*Record{},
+		IPLimiters:       map[string]*Limiter{},
+		grants:           map[string][]string{},
+		History:          NewHistory(256),
 	}
 }
 
+// Mut runs m under s.Lock and republishes the whole routing snapshot,
+// m may change the routing maps in any way
 func (s *Store) Mut(m func(*Store)) {
 	s.Lock.Lock()
 	m(s)
+	clear(s.touched)
+	s.routes.Store(s.routesLocked())
+	s.Lock.Unlock()
+	s.OnUpdate()
+}
+
+// update is a cheaper Mut for changes that call touchLocked on every key
+// whose record, standbys or alias they change, only those are republished
+func (s *Store) update(m func(*Store)) {
+	s.Lock.Lock()
+	m(s)
+	if prev := s.routes.Load(); prev == nil {
+		s.routes.Store(s.routesLocked())
+	} else if len(s.touched) > 0 {
+		s.routes.Store(s.patchRoutesLocked(prev))
+	}
+	clear(s.touched)
 	s.Lock.Unlock()
 	s.OnUpdate()
 }
@@ -81,9 +236,7 @@ func (s *Store) OnUpdate() {
 }
 
 func (s *Store) Records() (all []*Record) {
-	s.Lock.RLock()
-	all = maps.Values(s.RecordMap)
-	s.Lock.RUnlock()
+	all = s.Routes().All()
 	sort.Slice(all, func(i, j int) bool {
 		return all[i].Since.After(all[j].Since)
 	})
@@ -91,51 +244,72 @@ func (s *Store) Records() (all []*Record) {
 }
 
 func (s *Store) Alias(k string, v string) {
-	s.Mut(func(store *Store) {
+	s.update(func(store *Store) {
 		store.AliasMap[k] = v
+		store.touchLocked(k)
 	})
+	s.Events.Publish(aliasEvent(EventAliasSet, k, v))
 }
 
 func (s *Store) Unalias(k string) {
-	s.Mut(func(store *Store) {
+	s.update(func(store *Store) {
 		delete(store.AliasMap, k)
+		store.touchLocked(k)
 	})
+	s.Events.Publish(aliasEvent(EventAliasRemoved, k, ""))
 }
 
 func (s *Store) Aliases() (all map[string]string) {
-	s.Lock.RLock()
-	all = maps.Clone(s.AliasMap)
-	s.Lock.RUnlock()
-	return
+	return s.Routes().Aliases()
 }
 
 // lookup record by key, or alias
 func (s *Store) LookupRecord(k string) (rec *Record, ok bool) {
-	s.Lock.RLock()
-	rec, ok = s.RecordMap[k]
-	if !ok {
-		k, ok = s.AliasMap[k]
-		if ok {
-			rec, ok = s.RecordMap[k]
-		}
+	rec, ok = s.Routes().Lookup(k)
+	if ok && rec.Pool != nil {
+		rec = rec.Pool.Pick()
+		ok = rec != nil
 	}
-	s.Lock.RUnlock()
 	return
 }
 
 func (s *Store) RemoveSession(tssn tunnel.Session) {
-	s.Mut(func(store *Store) {
-		for _, rec := range store.RecordMap {
-			if rec.Session == tssn {
-				delete(store.RecordMap, rec.Key)
-				s.Logger.Debug("remove", "key", rec.Key)
-				break
-			}
-		}
-	})
+	s.removeSession(tssn, ReasonClosed)
+}
+
+func (s *Store) removeSession(tssn tunnel.Session, reason string) {
+	s.unroute(tssn, reason)
 	expvars.WebteleportRelaySessionsClosed.Add(1)
 }
 
+// unroute stops routing to the records of tssn, promoting standbys where possible
+func (s *Store) unroute(tssn tunnel.Session, reason string) (removed []*Record) {
+	var promoted []*Record
+	s.update(func(store *Store) {
+		removed, promoted = store.removeLocked(tssn)
+	})
+	s.closed(reason, removed...)
+	for _, rec := range removed {
+		s.Events.Publish(removedEvent(rec, reason))
+		s.releaseHostnames(rec)
+	}
+	for _, rec := range promoted {
+		_ = rec.Control.Send(ControlMessage{Type: "promoted"})
+		s.Events.Publish(recordEvent(EventRecordUpdated, rec))
+	}
+	return removed
+}
+
+// sessionRecord finds a record, pooled or standby, served by tssn
+func (s *Store) sessionRecord(tssn tunnel.Session) (*Record, bool) {
+	s.Lock.RLock()
+	defer s.Lock.RUnlock()
+	for _, rec := range s.Sessions[tssn] {
+		return rec, true
+	}
+	return nil, false
+}
+
 func (s *Store) GetRecord(h string) (*Record, bool) {
 	k := utils.StripPort(h)
 	k = ToIdna(k)
@@ -158,110 +332,346 @@ func (s *Store) Allocate(r *edge.Edge) (key string, err error) {
 }
 
 func (s *Store) allocateTCP(r *edge.Edge) (string, error) {
-	port, err := freeport.GetFreePort()
+	addr := ":0"
+	if k, ok := s.persistedPort(r.Path); ok {
+		addr = k
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil && addr != ":0" {
+		ln, err = net.Listen("tcp", ":0")
+	}
 	if err != nil {
 		return "", fmt.Errorf("failed to allocate tcp port: %w", err)
 	}
-	return fmt.Sprintf(":%d", port), nil
+	k := fmt.Sprintf(":%d", ln.Addr().(*net.TCPAddr).Port)
+	s.Lock.Lock()
+	s.Listeners[k] = ln
+	s.Lock.Unlock()
+	return k, nil
 }
 
 func (s *Store) allocateHTTP(r *edge.Edge) (string, error) {
+	pub, err := edgePublicKey(r)
+	if err != nil {
+		return "", err
+	}
+	if pub != nil {
+		return encodePublicKey(pub), nil
+	}
 	k := deriveOnionID(r.Path)
 	return k, nil
 }
 
-func (s *Store) Upsert(k string, r *edge.Edge) {
+func (s *Store) Upsert(k string, r *edge.Edge) error {
+	_, err := s.upsert(k, r, "", NewControl(r))
+	return err
+}
+
+// upsert registers r under k, ctl must be the only Control of r.Stream
+func (s *Store) upsert(k string, r *edge.Edge, principal string, ctl *Control) (rec *Record, err error) {
+	// claim the listener bound by Allocate first, so that every error below closes it
+	var ln net.Listener
+	if edgeProtocol(r) == "tcp" {
+		s.Lock.Lock()
+		ln = s.Listeners[k]
+		delete(s.Listeners, k)
+		s.Lock.Unlock()
+	}
+	defer func() {
+		if err != nil && ln != nil {
+			ln.Close()
+		}
+	}()
+
+	pub, err := edgePublicKey(r)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := ParseIngressPolicy(r.Values)
+	if err != nil {
+		return nil, err
+	}
+	strategy, pooled, err := poolStrategy(r.Values)
+	if err != nil {
+		return nil, err
+	}
+	limits, err := s.Limits.Lower(r.Values)
+	if err != nil {
+		return nil, err
+	}
 	since := time.Now()
-	header := tags.Tags{Values: url.Values(r.Header)}
-	tags := tags.Tags{Values: r.Values}
-	rec := &Record{
-		Key:     k,
-		Session: r.Session,
-		Header:  header,
-		Tags:    tags,
-		Since:   since,
-		IP:      r.RealIP,
-		Path:    r.Path,
+	header := tags.Tags{Values: url.Values(r.Header.Clone())}
+	header.Del("Authorization")
+	tags := tags.Tags{Values: maps.Clone(r.Values)}
+	tags.Del("token")
+	tags.Del("sig")
+	tags.Del("auth")
+	rec = &Record{
+		Key:       k,
+		ID:        newRecordID(),
+		Session:   r.Session,
+		Control:   ctl,
+		Header:    header,
+		Tags:      tags,
+		Since:     since,
+		IP:        r.RealIP,
+		Path:      r.Path,
+		Principal: principal,
+		Policy:    policy,
+		Transport: sessionTransport(r.Session),
+		Limits:    limits,
+		Listener:  ln,
+	}
+	if pub != nil {
+		rec.PublicKey = base64.RawURLEncoding.EncodeToString(pub)
+	}
+	if rec.Control.answersPings() {
+		rec.Heartbeat = NewHeartbeat()
 	}
 
 	if edgeProtocol(r) == "http" {
 		rec.RoundTripper = RoundTripper(r.Session)
 	}
 
-	var has bool
-	s.Mut(func(store *Store) {
-		_, has = store.RecordMap[k]
+	var has, joined bool
+	var replaced *Record
+	s.update(func(store *Store) {
+		if store.closing.Load() {
+			err = ErrShuttingDown
+			return
+		}
+		store.touchLocked(k)
+		var old *Record
+		old, has = store.RecordMap[k]
+		if has && old.PublicKey != "" && old.PublicKey != rec.PublicKey {
+			err = ErrKeyOwned
+			return
+		}
+		var replacing *Record
+		if has && !(pooled && old.Pool != nil) && store.Takeover != TakeoverStandby {
+			replacing = old
+		}
+		if err = store.checkQuotaLocked(rec, replacing); err != nil {
+			return
+		}
+		store.attachLimitersLocked(rec)
+		defer func() {
+			if err != nil {
+				store.detachLimitersLocked(rec)
+			} else {
+				store.indexLocked(rec)
+			}
+		}()
+		if pooled && has && old.Pool != nil {
+			rec.Pool = old.Pool
+			rec.Pool.Add(rec)
+			joined = true
+			return
+		}
+		if pooled {
+			rec.Pool = NewPool(strategy, rec)
+		}
+		if has {
+			replaced, err = store.takeoverLocked(old, rec)
+			return
+		}
 		store.RecordMap[k] = rec
+		delete(store.Persisted, k)
 	})
+	if err != nil {
+		return nil, err
+	}
+	if replaced != nil {
+		s.closeReplaced(replaced)
+	}
 
 	var action string
-	if has {
+	if joined {
+		action = "join"
+		s.Events.Publish(recordEvent(EventRecordInserted, rec))
+	} else if rec.isStandby() {
+		action = "standby"
+	} else if has {
 		action = "update"
+		s.Events.Publish(recordEvent(EventRecordUpdated, rec))
 	} else {
 		action = "insert"
+		s.Events.Publish(recordEvent(EventRecordInserted, rec))
 	}
 	s.Logger.Debug(action, "key", rec.Key, "ip", rec.IP)
 
-	if os.Getenv("PING") != "" {
-		go s.Ping(r)
+	go s.heartbeat(rec)
+	go s.serveControl(rec)
+	if rec.Listener != nil {
+		go s.ServeTCP(rec)
 	}
-	go s.Scan(r)
+	s.reaper.Do(func() { s.background(s.reapLoop) })
 
 	expvars.WebteleportRelaySessionsAccepted.Add(1)
+	return rec, nil
 }
 
 func (s *Store) Ping(r *edge.Edge) {
-	for {
-		time.Sleep(s.PingInterval)
-		_, err := io.WriteString(r.Stream, "\n")
-		if err != nil {
-			break
-		}
-	}
-	s.RemoveSession(r.Session)
+	s.heartbeat(s.edgeRecord(r))
 }
 
 func (s *Store) Scan(r *edge.Edge) {
-	scanner := bufio.NewScanner(r.Stream)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line == "" || line == "PONG" {
-			continue
-		}
-		if line == "CLOSE" {
-			break
-		}
-		s.Logger.Warn(fmt.Sprintf("stm0: unknown command: %s", line))
+	s.serveControl(s.edgeRecord(r))
+}
+
+// edgeRecord returns the record of r, or a detached one if it was never upserted
+func (s *Store) edgeRecord(r *edge.Edge) *Record {
+	if rec, ok := s.sessionRecord(r.Session); ok {
+		return rec
 	}
-	s.RemoveSession(r.Session)
+	return &Record{Session: r.Session, Control: NewControl(r)}
 }
 
 func (s *Store) Subscribe(upgrader edge.Upgrader) {
+	_ = s.SubscribeContext(context.Background(), upgrader)
+}
+
+// SubscribeContext registers edges from upgrader until it is exhausted, the
+// store shuts down, or ctx is done. On cancellation it closes the sessions it
+// accepted and returns ctx.Err(), otherwise io.EOF or ErrShuttingDown.
+//
+// Upgrade can not be interrupted, so on cancellation an upgrader that is an
+// io.Closer, like the tcp and quic-go ones, is closed to unblock it. For other
+// upgraders the goroutine blocked in Upgrade lingers until the next edge
+// arrives, which it then closes.
+func (s *Store) SubscribeContext(ctx context.Context, upgrader edge.Upgrader) error {
+	if !s.trackUpgrader(upgrader) {
+		return ErrShuttingDown
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type upgrade struct {
+		r   *edge.Edge
+		err error
+	}
+	upgrades := make(chan upgrade)
+	go func() {
+		for {
+			r, err := upgrader.Upgrade()
+			select {
+			case upgrades <- upgrade{r, err}:
+			case <-ctx.Done():
+				// accepted too late, nobody is going to register it
+				if r != nil {
+					_ = r.Session.Close()
+				}
+				return
+			}
+			if err == io.EOF {
+				return
+			}
+		}
+	}()
+
+	var lock sync.Mutex
+	sessions := map[tunnel.Session]struct{}{}
 	for {
-		r, err := upgrader.Upgrade()
-		if err == io.EOF {
-			s.Logger.Warn("upgrade EOF")
-			break
+		var u upgrade
+		select {
+		case <-ctx.Done():
+			if c, ok := upgrader.(io.Closer); ok {
+				_ = c.Close()
+			}
+			lock.Lock()
+			for tssn := range sessions {
+				_ = tssn.Close()
+			}
+			lock.Unlock()
+			return ctx.Err()
+		case u = <-upgrades:
 		}
 
-		if err != nil {
-			s.Logger.Warn(fmt.Sprintf("upgrade session failed: %s", err))
-			continue
+		if u.err == io.EOF {
+			s.Logger.Warn("upgrade EOF")
+			return io.EOF
 		}
 
-		s.Logger.Debug("subscribe", "request", r)
+		if u.err != nil && s.closing.Load() {
+			return ErrShuttingDown
+		}
 
-		key, err := s.Allocate(r)
-		if err != nil {
-			s.Logger.Warn(fmt.Sprintf("allocate resource failed: %s", err))
-			_, _ = io.WriteString(r.Stream, fmt.Sprintf("ERR %s\n", err))
+		if u.err != nil {
+			s.Logger.Warn(fmt.Sprintf("upgrade session failed: %s", u.err))
 			continue
 		}
 
-		_, _ = io.WriteString(r.Stream, fmt.Sprintf("HOST %s\n", key))
+		tssn := u.r.Session
+		lock.Lock()
+		sessions[tssn] = struct{}{}
+		lock.Unlock()
+		go func() {
+			<-tssn.Context().Done()
+			lock.Lock()
+			delete(sessions, tssn)
+			lock.Unlock()
+		}()
+		go s.register(u.r)
+	}
+}
+
+// register allocates a key for the edge and reports it back to the client
+func (s *Store) register(r *edge.Edge) {
+	s.Logger.Debug("subscribe", "request", r)
+	ctl := NewControl(r)
+
+	if s.closing.Load() {
+		s.reject(r, ctl, ErrShuttingDown)
+		return
+	}
+
+	principal, err := s.Authenticate(r)
+	if err != nil {
+		s.Logger.Warn(fmt.Sprintf("authenticate failed: %s", err))
+		s.reject(r, ctl, err)
+		return
+	}
+
+	if err := s.VerifyOwnership(r); err != nil {
+		s.Logger.Warn(fmt.Sprintf("verify ownership failed: %s", err))
+		s.reject(r, ctl, err)
+		return
+	}
+
+	key, err := s.Allocate(r)
+	if err != nil {
+		s.Logger.Warn(fmt.Sprintf("allocate resource failed: %s", err))
+		s.reject(r, ctl, err)
+		return
+	}
+
+	rec, err := s.upsert(key, r, principal, ctl)
+	if err != nil {
+		s.Logger.Warn(fmt.Sprintf("upsert failed: %s", err))
+		s.reject(r, ctl, err)
+		return
+	}
+
+	_ = rec.Control.Send(ControlMessage{Type: "host", Host: key})
+	_ = rec.Control.hello()
+	if rec.isStandby() {
+		_ = rec.Control.Send(ControlMessage{Type: "standby"})
+	}
+}
 
-		s.Upsert(key, r)
+// rejectGrace is how long a rejected client gets to read its ERR before
+// the relay closes the session
+const rejectGrace = time.Second
+
+// reject reports err to the client of r and closes its session, an edge
+// without a record is never reaped, so it must not be left open
+func (s *Store) reject(r *edge.Edge, ctl *Control, err error) {
+	_ = ctl.Send(ControlMessage{Type: "error", Error: err.Error()})
+	select {
+	case <-r.Session.Context().Done():
+	case <-time.After(rejectGrace):
 	}
+	_ = r.Session.Close()
 }
 
 func edgeProtocol(r *edge.Edge) string {
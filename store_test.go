@@ -0,0 +1,210 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btwiuse/tags"
+	"github.com/webteleport/webteleport/edge"
+	"github.com/webteleport/webteleport/tunnel"
+)
+
+// fakeSession is a tunnel.Session without streams
+type fakeSession struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newFakeSession() *fakeSession {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &fakeSession{ctx: ctx, cancel: cancel}
+}
+
+func (f *fakeSession) Accept(ctx context.Context) (tunnel.Stream, error) {
+	<-f.ctx.Done()
+	return nil, io.EOF
+}
+
+func (f *fakeSession) Open(ctx context.Context) (tunnel.Stream, error) {
+	return nil, io.EOF
+}
+
+func (f *fakeSession) Close() error {
+	f.cancel()
+	return nil
+}
+
+func (f *fakeSession) Context() context.Context {
+	return f.ctx
+}
+
+// newTestStream returns a stream whose peer discards everything written to it
+func newTestStream() net.Conn {
+	conn, peer := net.Pipe()
+	go io.Copy(io.Discard, peer)
+	return conn
+}
+
+// newTestStore returns a quiet Store
+func newTestStore() *Store {
+	s := NewStore()
+	s.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	return s
+}
+
+// addTestRecord routes key to a new record on its own fake session
+func addTestRecord(s *Store, key string) *Record {
+	rec := &Record{
+		Key:     key,
+		ID:      newRecordID(),
+		Session: newFakeSession(),
+		Control: &Control{Stream: newTestStream()},
+		Tags:    tags.Tags{Values: map[string][]string{}},
+		Since:   time.Now(),
+		IP:      "127.0.0.1",
+	}
+	s.update(func(store *Store) {
+		store.RecordMap[key] = rec
+		store.indexLocked(rec)
+		store.touchLocked(key)
+	})
+	return rec
+}
+
+func TestRequestHostnames(t *testing.T) {
+	s := newTestStore()
+	s.MaxHostnames = 2
+	rec := addTestRecord(s, "client")
+	addTestRecord(s, "other")
+	if _, err := s.SetAlias("www", "other"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.requestHostnames(rec, []string{"www"}); !errors.Is(err, ErrHostnameTaken) {
+		t.Errorf("hijacking an operator alias: got %v, want %v", err, ErrHostnameTaken)
+	}
+	if _, err := s.requestHostnames(rec, []string{"other"}); !errors.Is(err, ErrAliasConflict) {
+		t.Errorf("shadowing a live key: got %v, want %v", err, ErrAliasConflict)
+	}
+	granted, err := s.requestHostnames(rec, []string{"a", "b", "c"})
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("exceeding MaxHostnames: got %v, want %v", err, ErrQuotaExceeded)
+	}
+	if len(granted) != 2 {
+		t.Errorf("granted %v, want [a b]", granted)
+	}
+
+	s.removeSession(rec.Session, ReasonClosed)
+	aliases := s.Aliases()
+	if aliases["www"] != "other" {
+		t.Errorf("operator alias www was released: %v", aliases)
+	}
+	for _, name := range granted {
+		if _, ok := aliases[name]; ok {
+			t.Errorf("hostname %s outlived its record", name)
+		}
+	}
+	if _, err := s.requestHostnames(rec, []string{"late"}); !errors.Is(err, ErrTargetNotFound) {
+		t.Errorf("requesting after removal: got %v, want %v", err, ErrTargetNotFound)
+	}
+}
+
+// closingUpgrader blocks in Upgrade until it is closed
+type closingUpgrader struct {
+	closed   chan struct{}
+	returned chan struct{}
+	once     sync.Once
+}
+
+func (u *closingUpgrader) Upgrade() (*edge.Edge, error) {
+	<-u.closed
+	close(u.returned)
+	return nil, io.EOF
+}
+
+func (u *closingUpgrader) IsRoot(string) bool {
+	return false
+}
+
+func (u *closingUpgrader) Close() error {
+	u.once.Do(func() { close(u.closed) })
+	return nil
+}
+
+func TestSubscribeContextClosesUpgrader(t *testing.T) {
+	s := newTestStore()
+	u := &closingUpgrader{closed: make(chan struct{}), returned: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.SubscribeContext(ctx, u)
+	}()
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("got %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SubscribeContext did not return")
+	}
+	select {
+	case <-u.returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Upgrade is still blocked after cancellation")
+	}
+}
+
+// benchmarkRecordCounts are the store sizes lookups and removals are measured
+// at, their cost must not grow with the number of records
+var benchmarkRecordCounts = []int{100, 1000, 10000, 100000}
+
+// newBenchmarkStore returns a store holding n records
+func newBenchmarkStore(n int) *Store {
+	s := newTestStore()
+	for i := range n {
+		addTestRecord(s, fmt.Sprintf("k%d", i))
+	}
+	return s
+}
+
+func BenchmarkLookupRecord(b *testing.B) {
+	for _, n := range benchmarkRecordCounts {
+		b.Run(fmt.Sprintf("records=%d", n), func(b *testing.B) {
+			s := newBenchmarkStore(n)
+			keys := make([]string, n)
+			for i := range keys {
+				keys[i] = fmt.Sprintf("k%d", i)
+			}
+			b.ResetTimer()
+			for i := range b.N {
+				if _, ok := s.LookupRecord(keys[i%n]); !ok {
+					b.Fatalf("%s not found", keys[i%n])
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkRemoveSession(b *testing.B) {
+	for _, n := range benchmarkRecordCounts {
+		b.Run(fmt.Sprintf("records=%d", n), func(b *testing.B) {
+			s := newBenchmarkStore(n)
+			s.Quotas = Quotas{Total: n + 1}
+			b.ResetTimer()
+			for range b.N {
+				b.StopTimer()
+				rec := addTestRecord(s, "churn")
+				b.StartTimer()
+				s.RemoveSession(rec.Session)
+			}
+		})
+	}
+}
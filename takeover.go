@@ -0,0 +1,194 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/webteleport/webteleport/tunnel"
+)
+
+// Takeover policies decide what happens when a key that is already
+// held by a live record is registered again
+const (
+	// refuse the newcomer with ERR key is in use
+	TakeoverReject = "reject"
+	// make the newcomer primary, and tell the old client CLOSE replaced before closing it
+	TakeoverReplace = "replace"
+	// keep the newcomer as a hot standby, it is told STANDBY after HOST,
+	// and PROMOTED once the primary goes away
+	TakeoverStandby = "standby"
+)
+
+var ErrKeyInUse = errors.New("key is in use")
+
+// takeoverLocked applies s.Takeover to rec registering over the live record old,
+// caller must hold s.Lock
+//
+// It returns the record to close if old was replaced
+func (s *Store) takeoverLocked(old, rec *Record) (replaced *Record, err error) {
+	switch s.Takeover {
+	case TakeoverReject:
+		return nil, ErrKeyInUse
+	case TakeoverStandby:
+		rec.mu.Lock()
+		rec.Standby = true
+		rec.mu.Unlock()
+		s.StandbyMap[rec.Key] = append(s.StandbyMap[rec.Key], rec)
+		return nil, nil
+	case TakeoverReplace, "":
+		s.RecordMap[rec.Key] = rec
+		if old.Pool != nil {
+			for _, member := range old.Pool.Members() {
+				s.detachLimitersLocked(member)
+				s.unindexLocked(member)
+			}
+		} else {
+			s.detachLimitersLocked(old)
+			s.unindexLocked(old)
+		}
+		return old, nil
+	default:
+		return nil, fmt.Errorf("unknown takeover policy %q", s.Takeover)
+	}
+}
+
+// closeReplaced notifies the clients of a replaced record and closes their sessions
+func (s *Store) closeReplaced(old *Record) {
+	members := []*Record{old}
+	if old.Pool != nil {
+		members = old.Pool.Members()
+	}
+	s.closed(ReasonReplaced, members...)
+	for _, rec := range members {
+		if rec.Control != nil {
+			_ = rec.Control.Send(ControlMessage{Type: "close", Reason: "replaced"})
+		}
+		if rec.Listener != nil {
+			rec.Listener.Close()
+		}
+		_ = rec.Session.Close()
+	}
+}
+
+// removeLocked drops every record served by tssn, promoting standbys where
+// a key is left without a primary, caller must hold s.Lock
+//
+// Standby records are dropped silently and not reported as removed.
+func (s *Store) removeLocked(tssn tunnel.Session) (removed, promoted []*Record) {
+	for _, rec := range s.Sessions[tssn] {
+		ok, p := s.removeRecordLocked(rec)
+		if ok {
+			removed = append(removed, rec)
+		}
+		if p != nil {
+			promoted = append(promoted, p)
+		}
+		s.unindexLocked(rec)
+	}
+	return
+}
+
+// removeRecordLocked drops rec, reporting whether it was routable and the
+// standby promoted in its place, caller must hold s.Lock
+func (s *Store) removeRecordLocked(rec *Record) (removed bool, promoted *Record) {
+	s.touchLocked(rec.Key)
+	if rec.Standby {
+		standbys := s.StandbyMap[rec.Key]
+		i := slices.Index(standbys, rec)
+		if i < 0 {
+			return false, nil
+		}
+		standbys = append(standbys[:i:i], standbys[i+1:]...)
+		if len(standbys) == 0 {
+			delete(s.StandbyMap, rec.Key)
+		} else {
+			s.StandbyMap[rec.Key] = standbys
+		}
+		s.detachLimitersLocked(rec)
+		s.Logger.Debug("remove standby", "key", rec.Key)
+		return false, nil
+	}
+
+	primary, ok := s.RecordMap[rec.Key]
+	if !ok {
+		return false, nil
+	}
+	if rec.Pool != nil && primary.Pool == rec.Pool {
+		member, left := rec.Pool.Remove(rec.Session)
+		if member == nil {
+			return false, nil
+		}
+		if left == 0 {
+			delete(s.RecordMap, rec.Key)
+			s.persistLocked(rec)
+			promoted = s.promoteLocked(rec.Key)
+		} else if primary == rec {
+			s.RecordMap[rec.Key] = rec.Pool.Members()[0]
+		}
+		s.detachLimitersLocked(rec)
+		s.Logger.Debug("leave", "key", rec.Key, "left", left)
+		return true, promoted
+	}
+	if primary != rec {
+		return false, nil
+	}
+	delete(s.RecordMap, rec.Key)
+	s.persistLocked(rec)
+	if rec.Listener != nil {
+		rec.Listener.Close()
+	}
+	s.detachLimitersLocked(rec)
+	s.Logger.Debug("remove", "key", rec.Key)
+	return true, s.promoteLocked(rec.Key)
+}
+
+// indexLocked adds rec to the session index, caller must hold s.Lock
+func (s *Store) indexLocked(rec *Record) {
+	keys, ok := s.Sessions[rec.Session]
+	if !ok {
+		keys = map[string]*Record{}
+		s.Sessions[rec.Session] = keys
+	}
+	if prev := keys[rec.Key]; prev == rec {
+		return
+	} else if prev != nil {
+		s.usage.add(prev, -1)
+	}
+	keys[rec.Key] = rec
+	s.usage.add(rec, 1)
+}
+
+// unindexLocked removes rec from the session index, caller must hold s.Lock
+func (s *Store) unindexLocked(rec *Record) {
+	keys := s.Sessions[rec.Session]
+	if keys[rec.Key] != rec {
+		return
+	}
+	delete(keys, rec.Key)
+	s.usage.add(rec, -1)
+	if len(keys) == 0 {
+		delete(s.Sessions, rec.Session)
+	}
+}
+
+// promoteLocked makes the oldest standby of k primary, caller must hold s.Lock
+func (s *Store) promoteLocked(k string) *Record {
+	standbys := s.StandbyMap[k]
+	if len(standbys) == 0 {
+		return nil
+	}
+	rec := standbys[0]
+	s.touchLocked(k)
+	if len(standbys) == 1 {
+		delete(s.StandbyMap, k)
+	} else {
+		s.StandbyMap[k] = standbys[1:]
+	}
+	rec.mu.Lock()
+	rec.Standby = false
+	rec.mu.Unlock()
+	s.RecordMap[k] = rec
+	s.Logger.Debug("promote", "key", k, "ip", rec.IP)
+	return rec
+}
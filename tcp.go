@@ -0,0 +1,70 @@
+package relay
+
+import (
+	"io"
+	"net"
+)
+
+// ServeTCP accepts raw tcp connections on rec.Listener and splices
+// each one with a new stream opened on rec.Session
+//
+// It returns when the listener is closed by RemoveSession
+func (s *Store) ServeTCP(rec *Record) {
+	for {
+		conn, err := rec.Listener.Accept()
+		if err != nil {
+			s.Logger.Debug("tcp accept stopped", "key", rec.Key, "error", err)
+			return
+		}
+		go s.spliceTCP(rec, conn)
+	}
+}
+
+func (s *Store) spliceTCP(rec *Record, conn net.Conn) {
+	defer conn.Close()
+
+	release, ok := rec.Limiters.Acquire()
+	if !ok {
+		s.Logger.Debug("tcp connection over limit", "key", rec.Key)
+		return
+	}
+	defer release()
+
+	stm, err := rec.Session.Open(rec.Session.Context())
+	if err != nil {
+		s.Logger.Warn("open stream failed", "key", rec.Key, "error", err)
+		return
+	}
+	defer stm.Close()
+
+	expvars.WebteleportRelayStreamsSpawned.Add(1)
+	splice(conn, stm, rec.Limiters)
+	expvars.WebteleportRelayStreamsClosed.Add(1)
+}
+
+// splice copies bytes between the visitor conn and the tunnel stm in both
+// directions until both sides are done, throttled by ls
+func splice(conn, stm net.Conn, ls Limiters) {
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(stm, ls.Reader(conn))
+		closeWrite(stm)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(ls.Writer(conn), stm)
+		closeWrite(conn)
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
+
+// closeWrite half-closes c if supported, otherwise closes it entirely
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+		return
+	}
+	_ = c.Close()
+}
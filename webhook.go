@@ -0,0 +1,147 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Webhooks delivers Store events as json POST requests to a list of endpoints
+//
+// Every endpoint has its own bounded queue and worker, so neither a slow
+// receiver nor a slow Store subscriber can block Store.Mut; events that
+// do not fit in a full queue are dropped and logged
+type Webhooks struct {
+	Endpoints []string
+	// signs bodies as "X-Webteleport-Signature: sha256=<hex hmac>" if set
+	Secret     []byte
+	Client     *http.Client
+	Logger     *slog.Logger
+	QueueSize  int
+	MaxRetries int
+	// delay before the first retry, doubled on each further attempt
+	Backoff time.Duration
+}
+
+func NewWebhooks(endpoints []string, secret string) *Webhooks {
+	return &Webhooks{
+		Endpoints:  endpoints,
+		Secret:     []byte(secret),
+		Client:     &http.Client{Timeout: 10 * time.Second},
+		Logger:     DefaultLogger,
+		QueueSize:  256,
+		MaxRetries: 5,
+		Backoff:    time.Second,
+	}
+}
+
+// Watch delivers events of s until ctx is done
+func (wh *Webhooks) Watch(ctx context.Context, s *Store) {
+	queues := make([]chan Event, len(wh.Endpoints))
+	for i, endpoint := range wh.Endpoints {
+		queues[i] = make(chan Event, wh.QueueSize)
+		go wh.worker(ctx, endpoint, queues[i])
+	}
+
+	events, cancel := s.Watch()
+	defer func() { cancel() }()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok := <-events:
+			if !ok {
+				wh.Logger.Warn("webhook subscription dropped, resubscribing")
+				events, cancel = s.Watch()
+				continue
+			}
+			for i, q := range queues {
+				select {
+				case q <- e:
+				default:
+					wh.Logger.Warn("webhook queue full, dropping event", "endpoint", wh.Endpoints[i], "type", e.Type, "key", e.Key)
+				}
+			}
+		}
+	}
+}
+
+func (wh *Webhooks) worker(ctx context.Context, endpoint string, queue <-chan Event) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-queue:
+			if err := wh.deliver(ctx, endpoint, e); err != nil {
+				wh.Logger.Warn("webhook delivery failed", "endpoint", endpoint, "type", e.Type, "key", e.Key, "error", err)
+			}
+		}
+	}
+}
+
+// deliver posts e to endpoint, retrying network errors, 429 and 5xx with backoff
+func (wh *Webhooks) deliver(ctx context.Context, endpoint string, e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	backoff := wh.Backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := wh.post(ctx, endpoint, e, body)
+		if err == nil || !retry || attempt >= wh.MaxRetries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (wh *Webhooks) post(ctx context.Context, endpoint string, e Event, body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webteleport-Event", string(e.Type))
+	if len(wh.Secret) > 0 {
+		mac := hmac.New(sha256.New, wh.Secret)
+		mac.Write(body)
+		req.Header.Set("X-Webteleport-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := wh.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("unexpected status: %s", resp.Status)
+	default:
+		return false, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+}
+
+// webhooksFromEnv builds Webhooks from the comma separated WEBHOOKS and WEBHOOK_SECRET
+func webhooksFromEnv() *Webhooks {
+	endpoints := os.Getenv("WEBHOOKS")
+	if endpoints == "" {
+		return nil
+	}
+	return NewWebhooks(strings.Split(endpoints, ","), os.Getenv("WEBHOOK_SECRET"))
+}
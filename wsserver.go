@@ -1,6 +1,7 @@
 package relay
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/btwiuse/dispatcher"
@@ -17,6 +18,11 @@ func DefaultWSServer(host string) *WSServer {
 }
 
 func NewWSServer(host string, ingress Ingress) *WSServer {
+	return NewWSServerContext(context.Background(), host, ingress)
+}
+
+// NewWSServerContext subscribes ingress to the builtin upgrader until ctx is done
+func NewWSServerContext(ctx context.Context, host string, ingress Ingress) *WSServer {
 	hu := &websocket.Upgrader{
 		RootPatterns: []string{host},
 	}
@@ -24,13 +30,19 @@ func NewWSServer(host string, ingress Ingress) *WSServer {
 		Ingress:      ingress,
 		HTTPUpgrader: hu,
 	}
-	go ingress.Subscribe(hu)
+	stopped := make(chan error, 1)
+	s.Stopped = stopped
+	go func() {
+		stopped <- ingress.SubscribeContext(ctx, hu)
+	}()
 	return s
 }
 
 type WSServer struct {
 	Ingress
 	edge.HTTPUpgrader
+	// receives the result of the subscribe loop once it ends
+	Stopped <-chan error
 }
 
 func (s *WSServer) Dispatch(r *http.Request) (h http.Handler) {
@@ -1,6 +1,7 @@
 package relay
 
 import (
+	"context"
 	"crypto/tls"
 	"net/http"
 	"time"
@@ -21,6 +22,11 @@ func DefaultWTServer(host string) *WTServer {
 }
 
 func NewWTServer(host string, ingress Ingress) *WTServer {
+	return NewWTServerContext(context.Background(), host, ingress)
+}
+
+// NewWTServerContext subscribes ingress to the builtin upgrader until ctx is done
+func NewWTServerContext(ctx context.Context, host string, ingress Ingress) *WTServer {
 	hu := &webtransport.Upgrader{
 		Server: &wt.Server{
 			CheckOrigin: func(*http.Request) bool { return true },
@@ -42,7 +48,11 @@ func NewWTServer(host string, ingress Ingress) *WTServer {
 		},
 	}
 	wt.ConfigureHTTP3Server(hu.Server.H3)
-	go ingress.Subscribe(hu)
+	stopped := make(chan error, 1)
+	s.Stopped = stopped
+	go func() {
+		stopped <- ingress.SubscribeContext(ctx, hu)
+	}()
 	return s
 }
 
@@ -59,6 +69,8 @@ func (s *WTServer) WithTLSConfig(tlsConfig *tls.Config) *WTServer {
 type WTServer struct {
 	Ingress
 	*webtransport.Upgrader
+	// receives the result of the subscribe loop once it ends
+	Stopped <-chan error
 }
 
 func (s *WTServer) Dispatch(r *http.Request) (h http.Handler) {